@@ -1,6 +1,59 @@
 package bridge
 
+import "time"
+
 type Command struct {
 	Device  string
 	Payload string
+
+	// Name is the IoTF command name and CorrelationId identifies this
+	// command in the status events published for it
+	Name          string
+	CorrelationId string
+
+	// Confirmed asks the device to acknowledge the command within Timeout
+	// seconds
+	Confirmed bool
+	Timeout   uint
+
+	// Expires is when the command is dropped if it was not sent yet, never
+	// when zero. HighPriority commands go before the others queued for
+	// their device, and commands with the IdempotencyKey of one queued or
+	// sent recently are ignored.
+	Expires        time.Time
+	HighPriority   bool
+	IdempotencyKey string
+}
+
+type CommandStatus string
+
+const (
+	CommandQueued    CommandStatus = "queued"
+	CommandDelayed   CommandStatus = "delayed"
+	CommandSent      CommandStatus = "sent"
+	CommandDelivered CommandStatus = "delivered"
+	CommandFailed    CommandStatus = "failed"
+	CommandTimedOut  CommandStatus = "timed-out"
+	CommandExpired   CommandStatus = "expired"
+	CommandCancelled CommandStatus = "cancelled"
+	CommandDuplicate CommandStatus = "duplicate"
+	CommandRejected  CommandStatus = "rejected"
+)
+
+type CommandResult struct {
+	Command Command
+	Status  CommandStatus
+	Reason  string
+
+	// Rejection details why a rejected command cannot be sent
+	Rejection *CommandRejection
+}
+
+const RejectionPayloadTooLarge = "payloadTooLarge"
+
+type CommandRejection struct {
+	Code      string `json:"code"`
+	DataRate  string `json:"dataRate,omitempty"`
+	Length    int    `json:"length,omitempty"`
+	MaxLength int    `json:"maxLength,omitempty"`
 }
@@ -0,0 +1,14 @@
+package bridge
+
+// the stages of the bridge at which a message can fail
+const (
+	StageLrscParse        = "lrsc-parse"
+	StageIoTFRegistration = "iotf-registration"
+	StageDownlink         = "downlink"
+)
+
+// DeadLetters keeps the messages that failed at a stage of the bridge, so
+// they can be inspected and redriven
+type DeadLetters interface {
+	Add(stage, payload string, err error)
+}
@@ -0,0 +1,76 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Codec converts between the bytes exchanged with a device and the JSON
+// published to and received from IoTF
+type Codec interface {
+	// Decode turns an uplink PDU received on port into a JSON document
+	Decode(port uint, pdu []byte) ([]byte, error)
+
+	// Encode turns the payload of a command sent on port into a PDU
+	Encode(port uint, command []byte) ([]byte, error)
+}
+
+// DecodeOnly is implemented by codecs that may not encode commands; the
+// registry passes those commands on to the next codec in line
+type DecodeOnly interface {
+	Encodes() bool
+}
+
+func encodes(codec Codec) bool {
+	partial, ok := codec.(DecodeOnly)
+	return !ok || partial.Encodes()
+}
+
+var (
+	lock     sync.RWMutex
+	builtins = map[string]Codec{}
+)
+
+func init() {
+	Register("hex", Hex)
+	Register("base64", Base64)
+	Register("json", JSON)
+	Register("lpp", LPP)
+}
+
+// Register makes a codec available under name for Named
+func Register(name string, codec Codec) {
+	lock.Lock()
+	defer lock.Unlock()
+	builtins[name] = codec
+}
+
+// Named returns the codec registered under name
+func Named(name string) (Codec, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	codec, present := builtins[name]
+	if !present {
+		names := []string{}
+		for name := range builtins {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown codec %v, expected one of %v", name, strings.Join(names, ", "))
+	}
+	return codec, nil
+}
+
+// unwrapCommand returns the text of a command that is a JSON string, and the
+// command itself otherwise
+func unwrapCommand(command []byte) string {
+	var text string
+	if json.Unmarshal(command, &text) == nil {
+		return text
+	}
+	return strings.TrimSpace(string(command))
+}
@@ -0,0 +1,104 @@
+package codec
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hex", func() {
+	It("wraps uplinks in JSON", func() {
+		decoded, err := Hex.Decode(1, []byte{0x01, 0xab})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded).To(MatchJSON(`{"payload":"01ab"}`))
+	})
+
+	It("encodes commands given as text or as JSON strings", func() {
+		Expect(Hex.Encode(1, []byte("01ab"))).To(Equal([]byte{0x01, 0xab}))
+		Expect(Hex.Encode(1, []byte(`"01ab"`))).To(Equal([]byte{0x01, 0xab}))
+	})
+
+	It("rejects commands that are not hex", func() {
+		_, err := Hex.Encode(1, []byte("xyz"))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Base64", func() {
+	It("wraps uplinks in JSON", func() {
+		decoded, err := Base64.Decode(1, []byte{0x01, 0xab})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded).To(MatchJSON(`{"payload":"Aas="}`))
+	})
+
+	It("encodes commands", func() {
+		Expect(Base64.Encode(1, []byte(`"Aas="`))).To(Equal([]byte{0x01, 0xab}))
+	})
+})
+
+var _ = Describe("JSON", func() {
+	It("forwards JSON uplinks", func() {
+		Expect(JSON.Decode(1, []byte(`{"on":true}`))).To(MatchJSON(`{"on":true}`))
+	})
+
+	It("rejects uplinks that are not JSON", func() {
+		_, err := JSON.Decode(1, []byte{0x01})
+		Expect(err).To(MatchError("payload is not valid JSON"))
+	})
+
+	It("sends commands as compact JSON", func() {
+		Expect(JSON.Encode(1, []byte(`{ "on": true }`))).To(Equal([]byte(`{"on":true}`)))
+	})
+
+	It("rejects commands that are not JSON", func() {
+		_, err := JSON.Encode(1, []byte("on"))
+		Expect(err).To(MatchError("command is not valid JSON"))
+	})
+})
+
+var _ = Describe("Named", func() {
+	It("returns the built-in codecs", func() {
+		Expect(Named("hex")).To(Equal(Hex))
+		Expect(Named("base64")).To(Equal(Base64))
+		Expect(Named("json")).To(Equal(JSON))
+	})
+
+	It("rejects unknown codecs", func() {
+		_, err := Named("morse")
+		Expect(err).To(MatchError(ContainSubstring("Unknown codec morse")))
+	})
+})
+
+var _ = Describe("Registry", func() {
+	var registry *Registry
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+		registry.SetDeviceType("thermostat", JSON)
+		registry.SetPort(5, Base64)
+	})
+
+	It("falls back to Hex", func() {
+		Expect(registry.Codec("", 1)).To(Equal(Hex))
+	})
+
+	It("prefers the device type over the port", func() {
+		Expect(registry.Codec("thermostat", 5)).To(Equal(JSON))
+		Expect(registry.Codec("valve", 5)).To(Equal(Base64))
+	})
+
+	It("uses the configured default", func() {
+		registry.SetDefault(Base64)
+		Expect(registry.Codec("valve", 1)).To(Equal(Base64))
+	})
+
+	It("encodes with the next codec in line when one only decodes", func() {
+		schema, _ := ParseSchema([]byte(`{"fields": [{"name": "count", "offset": 0, "length": 1}]}`))
+		registry.SetDeviceType("meter", schema)
+		registry.SetPort(6, schema)
+
+		Expect(registry.Codec("meter", 5)).To(Equal(schema))
+		Expect(registry.Encoder("meter", 5)).To(Equal(Base64))
+		Expect(registry.Encoder("meter", 6)).To(Equal(Hex))
+		Expect(registry.Encoder("thermostat", 6)).To(Equal(JSON))
+	})
+})
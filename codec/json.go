@@ -0,0 +1,29 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// JSON is the codec of devices that send and receive JSON text themselves
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(port uint, pdu []byte) ([]byte, error) {
+	if !json.Valid(pdu) {
+		return nil, errors.New("payload is not valid JSON")
+	}
+	return pdu, nil
+}
+
+func (jsonCodec) Encode(port uint, command []byte) ([]byte, error) {
+	if !json.Valid(command) {
+		return nil, errors.New("command is not valid JSON")
+	}
+
+	compacted := &bytes.Buffer{}
+	err := json.Compact(compacted, command)
+	return compacted.Bytes(), err
+}
@@ -0,0 +1,246 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LPP is the Cayenne Low Power Payload codec. Every value is published as
+// "<type>_<channel>", e.g. {"temperature_1": 27.2, "digital_output_2": 1},
+// and commands are written the same way.
+var LPP Codec = lppCodec{}
+
+type lppCodec struct{}
+
+type lppType struct {
+	id     byte
+	name   string
+	fields []lppField
+}
+
+// lppField is a big endian integer of size bytes; its value is the integer
+// divided by divisor
+type lppField struct {
+	name    string
+	size    int
+	signed  bool
+	divisor float64
+}
+
+func (self lppType) size() int {
+	size := 0
+	for _, field := range self.fields {
+		size += field.size
+	}
+	return size
+}
+
+func scalar(size int, signed bool, divisor float64) []lppField {
+	return []lppField{{size: size, signed: signed, divisor: divisor}}
+}
+
+func vector(names []string, size int, signed bool, divisor float64) []lppField {
+	fields := []lppField{}
+	for _, name := range names {
+		fields = append(fields, lppField{name: name, size: size, signed: signed, divisor: divisor})
+	}
+	return fields
+}
+
+var xyz = []string{"x", "y", "z"}
+
+// the types of the Cayenne LPP specification, followed by the extended
+// types of the CayenneLPP library
+var lppTypes = []lppType{
+	{0, "digital_input", scalar(1, false, 1)},
+	{1, "digital_output", scalar(1, false, 1)},
+	{2, "analog_input", scalar(2, true, 100)},
+	{3, "analog_output", scalar(2, true, 100)},
+	{101, "luminosity", scalar(2, false, 1)},
+	{102, "presence", scalar(1, false, 1)},
+	{103, "temperature", scalar(2, true, 10)},
+	{104, "relative_humidity", scalar(1, false, 2)},
+	{113, "accelerometer", vector(xyz, 2, true, 1000)},
+	{115, "barometric_pressure", scalar(2, false, 10)},
+	{134, "gyrometer", vector(xyz, 2, true, 100)},
+	{136, "gps", []lppField{
+		{name: "latitude", size: 3, signed: true, divisor: 10000},
+		{name: "longitude", size: 3, signed: true, divisor: 10000},
+		{name: "altitude", size: 3, signed: true, divisor: 100},
+	}},
+
+	{100, "generic_sensor", scalar(4, false, 1)},
+	{116, "voltage", scalar(2, false, 100)},
+	{117, "current", scalar(2, false, 1000)},
+	{118, "frequency", scalar(4, false, 1)},
+	{120, "percentage", scalar(1, false, 1)},
+	{121, "altitude", scalar(2, true, 1)},
+	{125, "concentration", scalar(2, false, 1)},
+	{128, "power", scalar(2, false, 1)},
+	{130, "distance", scalar(4, false, 1000)},
+	{131, "energy", scalar(4, false, 1000)},
+	{132, "direction", scalar(2, false, 1)},
+	{133, "unixtime", scalar(4, false, 1)},
+	{135, "colour", vector([]string{"r", "g", "b"}, 1, false, 1)},
+	{142, "switch", scalar(1, false, 1)},
+}
+
+func lppTypeById(id byte) (lppType, bool) {
+	for _, candidate := range lppTypes {
+		if candidate.id == id {
+			return candidate, true
+		}
+	}
+	return lppType{}, false
+}
+
+func lppTypeByName(name string) (lppType, bool) {
+	for _, candidate := range lppTypes {
+		if candidate.name == name {
+			return candidate, true
+		}
+	}
+	return lppType{}, false
+}
+
+func (lppCodec) Decode(port uint, pdu []byte) ([]byte, error) {
+	values := make(map[string]interface{})
+
+	for offset := 0; offset < len(pdu); {
+		if offset+2 > len(pdu) {
+			return nil, errors.New("LPP payload ends inside a channel header")
+		}
+		channel, id := pdu[offset], pdu[offset+1]
+		offset += 2
+
+		valueType, known := lppTypeById(id)
+		if !known {
+			return nil, fmt.Errorf("unknown LPP type %v on channel %v", id, channel)
+		}
+		if offset+valueType.size() > len(pdu) {
+			return nil, fmt.Errorf("LPP payload ends inside the %v of channel %v", valueType.name, channel)
+		}
+
+		fields := make(map[string]interface{})
+		for _, field := range valueType.fields {
+			fields[field.name] = field.decode(pdu[offset : offset+field.size])
+			offset += field.size
+		}
+
+		key := fmt.Sprintf("%v_%v", valueType.name, channel)
+		if len(valueType.fields) == 1 {
+			values[key] = fields[""]
+		} else {
+			values[key] = fields
+		}
+	}
+
+	return json.Marshal(values)
+}
+
+func (lppCodec) Encode(port uint, command []byte) ([]byte, error) {
+	values := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(command, &values); err != nil {
+		return nil, fmt.Errorf("LPP command is not a JSON object: %v", err)
+	}
+
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pdu := []byte{}
+	for _, key := range keys {
+		separator := strings.LastIndex(key, "_")
+		if separator < 0 {
+			return nil, fmt.Errorf("LPP value %v is not named <type>_<channel>", key)
+		}
+
+		channel, err := strconv.ParseUint(key[separator+1:], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("LPP value %v has an invalid channel", key)
+		}
+
+		valueType, known := lppTypeByName(key[:separator])
+		if !known {
+			return nil, fmt.Errorf("unknown LPP type %v", key[:separator])
+		}
+
+		encoded, err := valueType.encode(values[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid LPP value %v: %v", key, err)
+		}
+
+		pdu = append(pdu, byte(channel), valueType.id)
+		pdu = append(pdu, encoded...)
+	}
+
+	return pdu, nil
+}
+
+func (self lppType) encode(value json.RawMessage) ([]byte, error) {
+	fields := make(map[string]float64)
+	if len(self.fields) == 1 {
+		var scalar float64
+		if err := json.Unmarshal(value, &scalar); err != nil {
+			return nil, errors.New("expected a number")
+		}
+		fields[""] = scalar
+	} else if err := json.Unmarshal(value, &fields); err != nil {
+		return nil, errors.New("expected an object of numbers")
+	}
+
+	encoded := []byte{}
+	for _, field := range self.fields {
+		number, present := fields[field.name]
+		if !present {
+			return nil, fmt.Errorf("missing %v", field.name)
+		}
+
+		bytes, err := field.encode(number)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, bytes...)
+	}
+	return encoded, nil
+}
+
+func (self lppField) decode(data []byte) float64 {
+	var raw int64
+	for _, b := range data {
+		raw = raw<<8 | int64(b)
+	}
+
+	bits := uint(8 * self.size)
+	if self.signed && raw&(1<<(bits-1)) != 0 {
+		raw -= 1 << bits
+	}
+	return float64(raw) / self.divisor
+}
+
+func (self lppField) encode(value float64) ([]byte, error) {
+	raw := int64(math.Floor(value*self.divisor + 0.5))
+
+	bits := uint(8 * self.size)
+	min, max := int64(0), int64(1)<<bits-1
+	if self.signed {
+		min, max = -(int64(1) << (bits - 1)), int64(1)<<(bits-1)-1
+	}
+	if raw < min || raw > max {
+		return nil, fmt.Errorf("%v is out of range", value)
+	}
+
+	data := make([]byte, self.size)
+	for i := self.size - 1; i >= 0; i-- {
+		data[i] = byte(raw)
+		raw >>= 8
+	}
+	return data, nil
+}
@@ -0,0 +1,122 @@
+package codec
+
+import (
+	"encoding/hex"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strings"
+)
+
+var _ = Describe("LPP", func() {
+	examples := []struct {
+		pdu, json string
+	}{
+		{"010001", `{"digital_input_1": 1}`},
+		{"020100", `{"digital_output_2": 0}`},
+		{"0302fc18", `{"analog_input_3": -10}`},
+		{"040304d2", `{"analog_output_4": 12.34}`},
+		{"056501f4", `{"luminosity_5": 500}`},
+		{"066601", `{"presence_6": 1}`},
+		{"076700fa", `{"temperature_7": 25}`},
+		{"0867ff9c", `{"temperature_8": -10}`},
+		{"096861", `{"relative_humidity_9": 48.5}`},
+		{"0a7104d2fb2e0000", `{"accelerometer_10": {"x": 1.234, "y": -1.234, "z": 0}}`},
+		{"0b732804", `{"barometric_pressure_11": 1024.4}`},
+		{"0c860064ff9c0000", `{"gyrometer_12": {"x": 1, "y": -1, "z": 0}}`},
+		{"0d8806765ff2960a0003e8", `{"gps_13": {"latitude": 42.3519, "longitude": -87.9094, "altitude": 10}}`},
+		{"0e6400012345", `{"generic_sensor_14": 74565}`},
+		{"0f7404d8", `{"voltage_15": 12.4}`},
+		{"107504d2", `{"current_16": 1.234}`},
+		{"117600000032", `{"frequency_17": 50}`},
+		{"127864", `{"percentage_18": 100}`},
+		{"1379ffce", `{"altitude_19": -50}`},
+		{"147d0190", `{"concentration_20": 400}`},
+		{"158003e8", `{"power_21": 1000}`},
+		{"168200003039", `{"distance_22": 12.345}`},
+		{"178300003039", `{"energy_23": 12.345}`},
+		{"18840168", `{"direction_24": 360}`},
+		{"19855f5e1000", `{"unixtime_25": 1600000000}`},
+		{"1a87ff8000", `{"colour_26": {"r": 255, "g": 128, "b": 0}}`},
+		{"1b8e01", `{"switch_27": 1}`},
+	}
+
+	It("covers every LPP type", func() {
+		for _, valueType := range lppTypes {
+			covered := false
+			for _, example := range examples {
+				covered = covered || strings.Contains(example.json, `"`+valueType.name+"_")
+			}
+			Expect(covered).To(BeTrue(), valueType.name)
+		}
+	})
+
+	for _, example := range examples {
+		example := example
+
+		It(fmt.Sprintf("decodes %v", example.json), func() {
+			pdu, _ := hex.DecodeString(example.pdu)
+			Expect(LPP.Decode(1, pdu)).To(MatchJSON(example.json))
+		})
+
+		It(fmt.Sprintf("encodes %v", example.json), func() {
+			pdu, err := LPP.Encode(1, []byte(example.json))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hex.EncodeToString(pdu)).To(Equal(example.pdu))
+		})
+	}
+
+	Describe("decoding", func() {
+		It("decodes several channels", func() {
+			pdu, _ := hex.DecodeString("03670110056700ff")
+			Expect(LPP.Decode(1, pdu)).To(MatchJSON(`{"temperature_3": 27.2, "temperature_5": 25.5}`))
+		})
+
+		It("rejects unknown types", func() {
+			_, err := LPP.Decode(1, []byte{1, 200, 0})
+			Expect(err).To(MatchError("unknown LPP type 200 on channel 1"))
+		})
+
+		It("rejects truncated payloads", func() {
+			_, err := LPP.Decode(1, []byte{1, 103, 0})
+			Expect(err).To(MatchError("LPP payload ends inside the temperature of channel 1"))
+
+			_, err = LPP.Decode(1, []byte{1})
+			Expect(err).To(MatchError("LPP payload ends inside a channel header"))
+		})
+	})
+
+	Describe("encoding", func() {
+		It("encodes several channels ordered by name", func() {
+			pdu, err := LPP.Encode(1, []byte(`{"digital_output_2": 1, "analog_output_1": 1.5}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hex.EncodeToString(pdu)).To(Equal("010300960201" + "01"))
+		})
+
+		It("rejects values that do not fit", func() {
+			_, err := LPP.Encode(1, []byte(`{"digital_output_1": 256}`))
+			Expect(err).To(MatchError("invalid LPP value digital_output_1: 256 is out of range"))
+		})
+
+		It("rejects unknown types and invalid names", func() {
+			_, err := LPP.Encode(1, []byte(`{"laser_1": 1}`))
+			Expect(err).To(MatchError("unknown LPP type laser"))
+
+			_, err = LPP.Encode(1, []byte(`{"temperature": 1}`))
+			Expect(err).To(MatchError("LPP value temperature is not named <type>_<channel>"))
+
+			_, err = LPP.Encode(1, []byte(`{"temperature_300": 1}`))
+			Expect(err).To(MatchError("LPP value temperature_300 has an invalid channel"))
+		})
+
+		It("rejects incomplete values", func() {
+			_, err := LPP.Encode(1, []byte(`{"gps_1": {"latitude": 1, "longitude": 2}}`))
+			Expect(err).To(MatchError("invalid LPP value gps_1: missing altitude"))
+		})
+
+		It("rejects commands that are not JSON objects", func() {
+			_, err := LPP.Encode(1, []byte(`0102`))
+			Expect(err).To(MatchError(ContainSubstring("LPP command is not a JSON object")))
+		})
+	})
+})
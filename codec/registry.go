@@ -0,0 +1,48 @@
+package codec
+
+// Registry picks the codec of a device by its device type, then by port,
+// and falls back to Hex
+type Registry struct {
+	deviceTypes map[string]Codec
+	ports       map[uint]Codec
+	fallback    Codec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{deviceTypes: make(map[string]Codec), ports: make(map[uint]Codec), fallback: Hex}
+}
+
+func (self *Registry) SetDefault(codec Codec) {
+	self.fallback = codec
+}
+
+func (self *Registry) SetDeviceType(deviceType string, codec Codec) {
+	self.deviceTypes[deviceType] = codec
+}
+
+func (self *Registry) SetPort(port uint, codec Codec) {
+	self.ports[port] = codec
+}
+
+// Encoder returns the codec for commands to a device type on port, skipping
+// the codecs that do not encode in favour of the port's and the default
+func (self *Registry) Encoder(deviceType string, port uint) Codec {
+	if codec, present := self.deviceTypes[deviceType]; present && deviceType != "" && encodes(codec) {
+		return codec
+	}
+	if codec, present := self.ports[port]; present && encodes(codec) {
+		return codec
+	}
+	return self.fallback
+}
+
+// Codec returns the codec for messages of a device type on port
+func (self *Registry) Codec(deviceType string, port uint) Codec {
+	if codec, present := self.deviceTypes[deviceType]; present && deviceType != "" {
+		return codec
+	}
+	if codec, present := self.ports[port]; present {
+		return codec
+	}
+	return self.fallback
+}
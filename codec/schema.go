@@ -0,0 +1,219 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+)
+
+// Schema decodes uplinks by a declarative description of their byte layout,
+// read from a JSON schema file:
+//
+//	{"fields": [
+//	  {"name": "temperature", "offset": 0, "length": 2, "signed": true, "scale": 0.1},
+//	  {"name": "battery", "offset": 2, "length": 2, "endianness": "little"},
+//	  {"name": "state", "offset": 4, "length": 1, "enum": {"0": "idle", "1": "busy"}},
+//	  {"name": "flags", "offset": 5, "length": 1, "bits": [{"name": "open", "bit": 0}]}
+//	]}
+type Schema struct {
+	Fields []SchemaField `json:"fields"`
+}
+
+// SchemaField is an integer of Length bytes at Offset. Its value is
+// multiplied by Scale, replaced by its Enum name or split into Bits.
+type SchemaField struct {
+	Name       string            `json:"name"`
+	Offset     int               `json:"offset"`
+	Length     int               `json:"length"`
+	Endianness string            `json:"endianness"`
+	Signed     bool              `json:"signed"`
+	Scale      float64           `json:"scale"`
+	Enum       map[string]string `json:"enum"`
+	Bits       []SchemaBits      `json:"bits"`
+}
+
+// SchemaBits is a bitfield of Length bits, 1 by default, starting at Bit,
+// counted from the least significant bit. Single bits are booleans.
+type SchemaBits struct {
+	Name   string            `json:"name"`
+	Bit    uint              `json:"bit"`
+	Length uint              `json:"length"`
+	Enum   map[string]string `json:"enum"`
+}
+
+// LoadSchema reads and validates a schema file
+func LoadSchema(path string) (*Schema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read schema: %v", err)
+	}
+
+	schema, err := ParseSchema(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schema %v: %v", path, err)
+	}
+	return schema, nil
+}
+
+func ParseSchema(data []byte) (*Schema, error) {
+	schema := &Schema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, err
+	}
+	return schema, schema.validate()
+}
+
+func (self *Schema) validate() error {
+	if len(self.Fields) == 0 {
+		return errors.New("no fields")
+	}
+
+	names := make(map[string]struct{})
+	claim := func(name string) error {
+		if name == "" {
+			return errors.New("field without a name")
+		}
+		if _, taken := names[name]; taken {
+			return fmt.Errorf("field %v is defined twice", name)
+		}
+		names[name] = struct{}{}
+		return nil
+	}
+
+	for _, field := range self.Fields {
+		if len(field.Bits) == 0 {
+			if err := claim(field.Name); err != nil {
+				return err
+			}
+		}
+		if err := field.validate(); err != nil {
+			return fmt.Errorf("field %v: %v", field.Name, err)
+		}
+		for _, bits := range field.Bits {
+			if err := claim(bits.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self SchemaField) validate() error {
+	if self.Offset < 0 {
+		return errors.New("negative offset")
+	}
+	if self.Length < 1 || self.Length > 8 {
+		return errors.New("length must be between 1 and 8 bytes")
+	}
+	if self.Endianness != "" && self.Endianness != "big" && self.Endianness != "little" {
+		return fmt.Errorf("unknown endianness %v", self.Endianness)
+	}
+	if err := validateEnum(self.Enum); err != nil {
+		return err
+	}
+	if len(self.Bits) > 0 && (self.Signed || self.Scale != 0 || self.Enum != nil) {
+		return errors.New("bitfields cannot be signed, scaled or enums")
+	}
+
+	for _, bits := range self.Bits {
+		if bits.Bit+bits.length() > uint(8*self.Length) {
+			return fmt.Errorf("bits of %v exceed the field", bits.Name)
+		}
+		if err := validateEnum(bits.Enum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateEnum(enum map[string]string) error {
+	for value := range enum {
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("enum value %v is not an integer", value)
+		}
+	}
+	return nil
+}
+
+func (self SchemaBits) length() uint {
+	if self.Length == 0 {
+		return 1
+	}
+	return self.Length
+}
+
+func (self *Schema) Decode(port uint, pdu []byte) ([]byte, error) {
+	values := make(map[string]interface{})
+
+	for _, field := range self.Fields {
+		if field.Offset+field.Length > len(pdu) {
+			return nil, fmt.Errorf("payload of %v bytes is too short for %v", len(pdu), field.Name)
+		}
+
+		raw := field.read(pdu[field.Offset : field.Offset+field.Length])
+		if len(field.Bits) == 0 {
+			values[field.Name] = field.value(raw)
+			continue
+		}
+
+		for _, bits := range field.Bits {
+			values[bits.Name] = bits.value(uint64(raw))
+		}
+	}
+
+	return json.Marshal(values)
+}
+
+func (self *Schema) Encode(port uint, command []byte) ([]byte, error) {
+	return nil, errors.New("schemas only decode uplinks")
+}
+
+func (self *Schema) Encodes() bool {
+	return false
+}
+
+func (self SchemaField) read(data []byte) int64 {
+	var raw uint64
+	for i := range data {
+		b := data[i]
+		if self.Endianness == "little" {
+			b = data[len(data)-1-i]
+		}
+		raw = raw<<8 | uint64(b)
+	}
+
+	bits := uint(8 * self.Length)
+	if self.Signed && bits < 64 && raw&(1<<(bits-1)) != 0 {
+		return int64(raw) - 1<<bits
+	}
+	return int64(raw)
+}
+
+func (self SchemaField) value(raw int64) interface{} {
+	if name, present := self.Enum[strconv.FormatInt(raw, 10)]; present {
+		return name
+	}
+	if self.Scale != 0 {
+		// dividing keeps scales like 0.1 exact in the published JSON
+		if inverse := 1 / self.Scale; inverse == math.Trunc(inverse) {
+			return float64(raw) / inverse
+		}
+		return float64(raw) * self.Scale
+	}
+	return raw
+}
+
+func (self SchemaBits) value(raw uint64) interface{} {
+	value := (raw >> self.Bit) & (1<<self.length() - 1)
+
+	if name, present := self.Enum[strconv.FormatUint(value, 10)]; present {
+		return name
+	}
+	if self.length() == 1 && self.Enum == nil {
+		return value == 1
+	}
+	return value
+}
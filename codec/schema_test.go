@@ -0,0 +1,99 @@
+package codec
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Schema", func() {
+	decode := func(schema string, pdu ...byte) ([]byte, error) {
+		parsed, err := ParseSchema([]byte(schema))
+		Expect(err).ToNot(HaveOccurred())
+		return parsed.Decode(1, pdu)
+	}
+
+	It("decodes big endian unsigned integers by default", func() {
+		Expect(decode(`{"fields": [{"name": "count", "offset": 1, "length": 2}]}`, 0xff, 0x01, 0x02)).To(MatchJSON(`{"count": 258}`))
+	})
+
+	It("decodes little endian and signed integers", func() {
+		schema := `{"fields": [
+			{"name": "little", "offset": 0, "length": 2, "endianness": "little"},
+			{"name": "signed", "offset": 2, "length": 2, "signed": true},
+			{"name": "byte", "offset": 4, "length": 1, "signed": true}
+		]}`
+		Expect(decode(schema, 0x01, 0x02, 0xff, 0x9c, 0x80)).To(MatchJSON(`{"little": 513, "signed": -100, "byte": -128}`))
+	})
+
+	It("scales values", func() {
+		schema := `{"fields": [
+			{"name": "temperature", "offset": 0, "length": 2, "signed": true, "scale": 0.1},
+			{"name": "pressure", "offset": 2, "length": 1, "scale": 2.5}
+		]}`
+		Expect(decode(schema, 0x01, 0x10, 0x04)).To(MatchJSON(`{"temperature": 27.2, "pressure": 10}`))
+	})
+
+	It("names enum values and keeps unknown ones as numbers", func() {
+		schema := `{"fields": [
+			{"name": "state", "offset": 0, "length": 1, "enum": {"0": "idle", "1": "busy"}},
+			{"name": "other", "offset": 1, "length": 1, "enum": {"0": "idle"}}
+		]}`
+		Expect(decode(schema, 0x01, 0x07)).To(MatchJSON(`{"state": "busy", "other": 7}`))
+	})
+
+	It("splits bitfields", func() {
+		schema := `{"fields": [{"offset": 0, "length": 1, "bits": [
+			{"name": "open", "bit": 0},
+			{"name": "locked", "bit": 1},
+			{"name": "level", "bit": 2, "length": 3},
+			{"name": "mode", "bit": 5, "length": 2, "enum": {"2": "eco"}}
+		]}]}`
+		Expect(decode(schema, 0x55)).To(MatchJSON(`{"open": true, "locked": false, "level": 5, "mode": "eco"}`))
+	})
+
+	It("rejects payloads that are too short", func() {
+		_, err := decode(`{"fields": [{"name": "count", "offset": 1, "length": 2}]}`, 0x01, 0x02)
+		Expect(err).To(MatchError("payload of 2 bytes is too short for count"))
+	})
+
+	It("does not encode commands", func() {
+		schema, _ := ParseSchema([]byte(`{"fields": [{"name": "count", "offset": 0, "length": 1}]}`))
+		_, err := schema.Encode(1, []byte("{}"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("validation", func() {
+		invalid := map[string]string{
+			`{"fields": []}`: "no fields",
+			`{"fields": [{"offset": 0, "length": 1}]}`:                                                       "field without a name",
+			`{"fields": [{"name": "a", "offset": 0, "length": 1}, {"name": "a", "offset": 1, "length": 1}]}`: "field a is defined twice",
+			`{"fields": [{"name": "a", "offset": -1, "length": 1}]}`:                                         "field a: negative offset",
+			`{"fields": [{"name": "a", "offset": 0, "length": 9}]}`:                                          "field a: length must be between 1 and 8 bytes",
+			`{"fields": [{"name": "a", "offset": 0, "length": 1, "endianness": "middle"}]}`:                  "field a: unknown endianness middle",
+			`{"fields": [{"name": "a", "offset": 0, "length": 1, "enum": {"on": "1"}}]}`:                     "field a: enum value on is not an integer",
+			`{"fields": [{"offset": 0, "length": 1, "bits": [{"name": "b", "bit": 7, "length": 2}]}]}`:       "field : bits of b exceed the field",
+			`{"fields": [{"offset": 0, "length": 1, "signed": true, "bits": [{"name": "b", "bit": 0}]}]}`:    "field : bitfields cannot be signed, scaled or enums",
+		}
+
+		for schema, message := range invalid {
+			schema, message := schema, message
+			It("rejects "+message, func() {
+				_, err := ParseSchema([]byte(schema))
+				Expect(err).To(MatchError(message))
+			})
+		}
+
+		It("reports the file of an invalid schema", func() {
+			dir, _ := ioutil.TempDir("", "lrsc-schema")
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "schema.json")
+			ioutil.WriteFile(file, []byte(`{"fields": []}`), 0600)
+
+			_, err := LoadSchema(file)
+			Expect(err).To(MatchError("Invalid schema " + file + ": no fields"))
+		})
+	})
+})
@@ -0,0 +1,276 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/robertkrimen/otto"
+	"io/ioutil"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultScriptTimeout = 100 * time.Millisecond
+	DefaultScriptSteps   = 1000000
+	DefaultScriptMemory  = 64 << 20
+
+	// the clock is read every this many steps
+	scriptClockInterval = 1000
+
+	// the bytes an element takes at least when a native function copies an
+	// array or a string into a new one
+	scriptElementSize = 16
+)
+
+var (
+	errScriptTimeout = errors.New("script timed out")
+	errScriptSteps   = errors.New("script exceeded its step limit")
+	errScriptMemory  = errors.New("script exceeded its memory limit")
+)
+
+// scriptGuards makes the native functions that build a new array or string
+// in a single step throw a RangeError when it would take more than limit
+// bytes, as the allocations are only measured between steps
+const scriptGuards = `(function (limit, elementSize) {
+	var apply = Function.prototype.apply;
+	function guard(object, name, size) {
+		var native = object[name];
+		Object.defineProperty(object, name, {writable: true, configurable: true, value: function () {
+			if (size(this, arguments) > limit) {
+				throw new RangeError(name + " exceeds the script's memory limit");
+			}
+			return apply.call(native, this, arguments);
+		}});
+	}
+	function elements(self) {
+		return (Object(self).length >>> 0) * elementSize;
+	}
+
+	Object.getOwnPropertyNames(Array.prototype).forEach(function (name) {
+		if (name !== "constructor" && name !== "length") {
+			guard(Array.prototype, name, elements);
+		}
+	});
+	guard(Function.prototype, "apply", function (self, args) {
+		return args[1] == null ? 0 : elements(args[1]);
+	});
+	guard(String.prototype, "split", elements);
+	guard(String.prototype, "replace", function (self, args) {
+		var replacement = typeof args[1] === "function" ? 1 : String(args[1]).length;
+		return String(self).length * Math.max(replacement, 1);
+	});
+})`
+
+// Script is a codec written in JavaScript. The script defines either or
+// both of
+//
+//	function Decode(fPort, bytes) { return {temperature: bytes[0]}; }
+//	function Encode(fPort, object) { return [object.on ? 1 : 0]; }
+//
+// Every call runs on a fresh copy of the script's global state.
+type Script struct {
+	path   string
+	limits ScriptLimits
+
+	lock             sync.Mutex
+	vm               *otto.Otto
+	decodes, encodes bool
+}
+
+// ScriptLimits bound every call of a script. Steps counts the statements
+// and expressions the call evaluates. The timeout is wall-clock time and
+// Memory the bytes the bridge allocates while the call runs, both checked
+// between steps. Native functions that would allocate more than Memory in
+// a single step, like joining a huge array, throw a RangeError instead.
+type ScriptLimits struct {
+	Timeout time.Duration
+	Steps   uint64
+	Memory  uint64
+}
+
+// LoadScript reads a script and runs its top level code
+func LoadScript(path string, limits ScriptLimits) (*Script, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read script: %v", err)
+	}
+
+	if limits.Timeout == 0 {
+		limits.Timeout = DefaultScriptTimeout
+	}
+	if limits.Steps == 0 {
+		limits.Steps = DefaultScriptSteps
+	}
+	if limits.Memory == 0 {
+		limits.Memory = DefaultScriptMemory
+	}
+
+	vm := otto.New()
+	guards, _ := vm.Run(scriptGuards)
+	if _, err := guards.Call(otto.NullValue(), limits.Memory, scriptElementSize); err != nil {
+		return nil, fmt.Errorf("Could not guard script memory: %v", err)
+	}
+
+	script := &Script{path: path, vm: vm, limits: limits}
+	_, err = script.run(script.vm, func(vm *otto.Otto) (otto.Value, error) {
+		return vm.Run(source)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	script.decodes = script.defines("Decode")
+	script.encodes = script.defines("Encode")
+	if !script.decodes && !script.encodes {
+		return nil, fmt.Errorf("Script %v defines neither Decode nor Encode", path)
+	}
+	return script, nil
+}
+
+func (self *Script) defines(function string) bool {
+	value, err := self.vm.Get(function)
+	return err == nil && value.IsFunction()
+}
+
+func (self *Script) copy() *otto.Otto {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.vm.Copy()
+}
+
+func (self *Script) Decode(port uint, pdu []byte) ([]byte, error) {
+	if !self.decodes {
+		return nil, fmt.Errorf("Script %v cannot decode uplinks", self.path)
+	}
+
+	bytes := make([]int, len(pdu))
+	for i, b := range pdu {
+		bytes[i] = int(b)
+	}
+	array, _ := json.Marshal(bytes)
+
+	result, err := self.run(self.copy(), func(vm *otto.Otto) (otto.Value, error) {
+		input, err := vm.Call("JSON.parse", nil, string(array))
+		if err != nil {
+			return otto.UndefinedValue(), err
+		}
+
+		decoded, err := vm.Call("Decode", nil, port, input)
+		if err != nil || !decoded.IsDefined() {
+			return decoded, err
+		}
+		return vm.Call("JSON.stringify", nil, decoded)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !result.IsString() {
+		return nil, fmt.Errorf("Script %v: Decode returned nothing", self.path)
+	}
+	return []byte(result.String()), nil
+}
+
+func (self *Script) Encodes() bool {
+	return self.encodes
+}
+
+func (self *Script) Encode(port uint, command []byte) ([]byte, error) {
+	if !self.encodes {
+		return nil, fmt.Errorf("Script %v cannot encode commands", self.path)
+	}
+	if !json.Valid(command) {
+		return nil, errors.New("command is not valid JSON")
+	}
+
+	result, err := self.run(self.copy(), func(vm *otto.Otto) (otto.Value, error) {
+		input, err := vm.Call("JSON.parse", nil, string(command))
+		if err != nil {
+			return otto.UndefinedValue(), err
+		}
+
+		encoded, err := vm.Call("Encode", nil, port, input)
+		if err != nil || !encoded.IsDefined() {
+			return encoded, err
+		}
+		return vm.Call("JSON.stringify", nil, encoded)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []interface{}
+	if !result.IsString() || json.Unmarshal([]byte(result.String()), &numbers) != nil {
+		return nil, fmt.Errorf("Script %v: Encode must return an array of bytes", self.path)
+	}
+
+	pdu := make([]byte, len(numbers))
+	for i, number := range numbers {
+		value, err := scriptByte(number)
+		if err != nil {
+			return nil, fmt.Errorf("Script %v: byte %v of Encode's result %v", self.path, i, err)
+		}
+		pdu[i] = value
+	}
+	return pdu, nil
+}
+
+func scriptByte(number interface{}) (byte, error) {
+	value, isNumber := number.(float64)
+	if !isNumber {
+		return 0, fmt.Errorf("is not a number: %v", number)
+	}
+
+	if value < 0 || value > 255 || value != float64(int(value)) {
+		return 0, fmt.Errorf("is not a byte: %v", value)
+	}
+	return byte(value), nil
+}
+
+// run calls body on vm and interrupts it when it exceeds the script's limits.
+// otto runs the function on its interrupt channel before every step, so the
+// function counts the steps and puts itself back for the next one.
+func (self *Script) run(vm *otto.Otto, body func(vm *otto.Otto) (otto.Value, error)) (result otto.Value, err error) {
+	deadline := time.Now().Add(self.limits.Timeout)
+	steps := uint64(0)
+	allocations := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	allocated := func() uint64 {
+		metrics.Read(allocations)
+		return allocations[0].Value.Uint64()
+	}
+	start := allocated()
+
+	var step func()
+	step = func() {
+		steps++
+		if steps > self.limits.Steps {
+			panic(errScriptSteps)
+		}
+		if steps%scriptClockInterval == 0 && time.Now().After(deadline) {
+			panic(errScriptTimeout)
+		}
+		if allocated()-start > self.limits.Memory {
+			panic(errScriptMemory)
+		}
+		vm.Interrupt <- step
+	}
+
+	vm.Interrupt = make(chan func(), 1)
+	vm.Interrupt <- step
+	defer func() {
+		vm.Interrupt = nil
+		if caught := recover(); caught != nil {
+			if caught != errScriptTimeout && caught != errScriptSteps && caught != errScriptMemory {
+				panic(caught)
+			}
+			err = fmt.Errorf("Script %v: %v", self.path, caught)
+		}
+	}()
+
+	result, err = body(vm)
+	if err != nil {
+		err = fmt.Errorf("Script %v: %v", self.path, err)
+	}
+	return result, err
+}
@@ -0,0 +1,153 @@
+package codec
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Script", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "lrsc-scripts")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	load := func(source string, limits ScriptLimits) (*Script, error) {
+		file := filepath.Join(dir, "codec.js")
+		ioutil.WriteFile(file, []byte(source), 0600)
+		return LoadScript(file, limits)
+	}
+
+	It("decodes uplinks", func() {
+		script, err := load(`function Decode(fPort, bytes) {
+			return {port: fPort, temperature: (bytes[0] << 8 | bytes[1]) / 10, count: bytes.length};
+		}`, ScriptLimits{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(script.Decode(3, []byte{0x01, 0x10})).To(MatchJSON(`{"port": 3, "temperature": 27.2, "count": 2}`))
+	})
+
+	It("encodes commands", func() {
+		script, err := load(`function Encode(fPort, command) { return [fPort, command.on ? 1 : 0]; }`, ScriptLimits{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(script.Encode(4, []byte(`{"on": true}`))).To(Equal([]byte{4, 1}))
+	})
+
+	It("does not keep state between calls", func() {
+		script, _ := load(`var calls = 0; function Decode(fPort, bytes) { calls++; return {calls: calls}; }`, ScriptLimits{})
+		script.Decode(1, nil)
+		Expect(script.Decode(1, nil)).To(MatchJSON(`{"calls": 1}`))
+	})
+
+	It("rejects scripts without functions", func() {
+		_, err := load(`var x = 1;`, ScriptLimits{})
+		Expect(err).To(MatchError(ContainSubstring("defines neither Decode nor Encode")))
+	})
+
+	It("rejects scripts that do not compile", func() {
+		_, err := load(`function Decode(`, ScriptLimits{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reports missing functions", func() {
+		script, _ := load(`function Decode(fPort, bytes) { return {}; }`, ScriptLimits{})
+		_, err := script.Encode(1, []byte(`{}`))
+		Expect(err).To(MatchError(ContainSubstring("cannot encode commands")))
+	})
+
+	It("reports errors thrown by the script", func() {
+		script, _ := load(`function Decode(fPort, bytes) { throw new Error("bad frame"); }`, ScriptLimits{})
+		_, err := script.Decode(1, nil)
+		Expect(err).To(MatchError(ContainSubstring("bad frame")))
+	})
+
+	It("rejects results that are not bytes", func() {
+		script, _ := load(`function Encode(fPort, command) { return command.bytes; }`, ScriptLimits{})
+
+		_, err := script.Encode(1, []byte(`{"bytes": [1, 256]}`))
+		Expect(err).To(MatchError(ContainSubstring("byte 1 of Encode's result is not a byte: 256")))
+
+		_, err = script.Encode(1, []byte(`{"bytes": "01"}`))
+		Expect(err).To(MatchError(ContainSubstring("Encode must return an array of bytes")))
+
+		_, err = script.Encode(1, []byte(`{}`))
+		Expect(err).To(MatchError(ContainSubstring("Encode must return an array of bytes")))
+	})
+
+	It("interrupts scripts that run too long", func() {
+		script, err := load(`function Decode(fPort, bytes) { while (true) {} }`, ScriptLimits{Timeout: 20 * time.Millisecond})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = script.Decode(1, nil)
+		Expect(err).To(MatchError(ContainSubstring("script timed out")))
+	})
+
+	It("interrupts scripts that take too many steps", func() {
+		script, _ := load(`function Decode(fPort, bytes) {
+			var hoard = [];
+			while (true) { hoard.push(new Array(1000).join("x") + hoard.length); }
+		}`, ScriptLimits{Timeout: time.Minute, Steps: 10000})
+
+		_, err := script.Decode(1, nil)
+		Expect(err).To(MatchError(ContainSubstring("script exceeded its step limit")))
+	})
+
+	It("interrupts scripts that allocate too much memory", func() {
+		script, _ := load(`function Decode(fPort, bytes) {
+			var s = "x";
+			for (var i = 0; i < 40; i++) { s = s + s; }
+			return {n: s.length};
+		}`, ScriptLimits{Timeout: time.Minute, Memory: 1 << 20})
+
+		_, err := script.Decode(1, nil)
+		Expect(err).To(MatchError(ContainSubstring("script exceeded its memory limit")))
+	})
+
+	It("refuses native calls that would allocate too much memory at once", func() {
+		script, _ := load(`function Decode(fPort, bytes) {
+			var s = new Array(20000001).join("x");
+			var t = s + s + s + s;
+			return {n: t.length};
+		}`, ScriptLimits{Timeout: time.Minute, Steps: 50})
+
+		_, err := script.Decode(1, nil)
+		Expect(err).To(MatchError(ContainSubstring("RangeError: join exceeds the script's memory limit")))
+	})
+
+	It("keeps the guarded functions working", func() {
+		script, _ := load(`function Decode(fPort, bytes) {
+			var doubled = bytes.map(function (b) { return b * 2; });
+			var keys = [];
+			for (var key in doubled) { keys.push(key); }
+			return {sum: Math.max.apply(null, doubled), text: "a-b".split("-").join("+").replace("+", "="), keys: keys};
+		}`, ScriptLimits{})
+
+		decoded, err := script.Decode(1, []byte{1, 2})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(MatchJSON(`{"sum": 4, "text": "a=b", "keys": ["0", "1"]}`))
+	})
+
+	It("counts the steps of every call on its own", func() {
+		script, _ := load(`function Decode(fPort, bytes) {
+			for (var i = 0; i < 100; i++) {}
+			return {};
+		}`, ScriptLimits{Steps: 1000})
+
+		for i := 0; i < 20; i++ {
+			_, err := script.Decode(1, nil)
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	It("reports unreadable files", func() {
+		_, err := LoadScript(filepath.Join(dir, "missing.js"), ScriptLimits{})
+		Expect(err).To(MatchError(ContainSubstring("Could not read script")))
+	})
+})
@@ -0,0 +1,35 @@
+package codec
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+)
+
+var (
+	// Hex publishes uplinks as {"payload": "<hex>"} and sends commands given
+	// as hex strings. It matches what LRSC itself puts on the wire.
+	Hex Codec = &wrapperCodec{encode: hex.EncodeToString, decode: hex.DecodeString}
+
+	// Base64 publishes uplinks as {"payload": "<base64>"} and sends commands
+	// given as base64 strings
+	Base64 Codec = &wrapperCodec{encode: base64.StdEncoding.EncodeToString, decode: base64.StdEncoding.DecodeString}
+)
+
+// wrapperCodec wraps the PDU, as text, in a JSON object
+type wrapperCodec struct {
+	encode func([]byte) string
+	decode func(string) ([]byte, error)
+}
+
+type wrappedPayload struct {
+	Payload string `json:"payload"`
+}
+
+func (self *wrapperCodec) Decode(port uint, pdu []byte) ([]byte, error) {
+	return json.Marshal(wrappedPayload{Payload: self.encode(pdu)})
+}
+
+func (self *wrapperCodec) Encode(port uint, command []byte) ([]byte, error) {
+	return self.decode(unwrapCommand(command))
+}
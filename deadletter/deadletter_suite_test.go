@@ -0,0 +1,15 @@
+package deadletter
+
+import (
+	"github.com/cromega/clogger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestDeadLetter(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	logger.SetLevel(clogger.Off)
+	RunSpecs(t, "Dead Letter Suite")
+}
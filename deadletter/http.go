@@ -0,0 +1,65 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ServeHTTP serves the queue under a prefix such as /deadLetters:
+//
+//	GET    /deadLetters?stage=<stage>   lists the letters
+//	GET    /deadLetters/<id>            shows a letter
+//	DELETE /deadLetters/<id>            deletes a letter
+//	POST   /deadLetters/<id>/redrive    hands a letter back to its stage
+func (self *Queue) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) == 1 {
+		if req.Method != "GET" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		self.reply(res, self.List(req.URL.Query().Get("stage")))
+		return
+	}
+
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || len(parts) > 3 || (len(parts) == 3 && parts[2] != "redrive") {
+		http.NotFound(res, req)
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && req.Method == "POST":
+		self.fail(res, self.Redrive(id))
+	case len(parts) == 2 && req.Method == "GET":
+		letter, err := self.Get(id)
+		if err != nil {
+			self.fail(res, err)
+			return
+		}
+		self.reply(res, letter)
+	case len(parts) == 2 && req.Method == "DELETE":
+		self.fail(res, self.Delete(id))
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (self *Queue) reply(res http.ResponseWriter, value interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(value)
+}
+
+// fail answers with the status of err, or no content without one
+func (self *Queue) fail(res http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		res.WriteHeader(http.StatusNoContent)
+	case err == ErrNotFound:
+		http.Error(res, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(res, err.Error(), http.StatusConflict)
+	}
+}
@@ -0,0 +1,66 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("HTTP API", func() {
+	var queue *Queue
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		res := httptest.NewRecorder()
+		queue.ServeHTTP(res, req)
+		return res
+	}
+
+	BeforeEach(func() {
+		queue, _ = Open("", 10)
+		queue.Add("one", "a", errors.New("broken"))
+		queue.Add("two", "b", errors.New("broken"))
+		queue.Handle("one", func(string) error { return nil })
+	})
+
+	It("lists the letters", func() {
+		res := request("GET", "/deadLetters?stage=two")
+
+		var letters []Letter
+		Expect(json.Unmarshal(res.Body.Bytes(), &letters)).To(Succeed())
+		Expect(letters).To(HaveLen(1))
+		Expect(letters[0].Id).To(BeEquivalentTo(2))
+	})
+
+	It("shows a letter", func() {
+		res := request("GET", "/deadLetters/1")
+
+		var letter Letter
+		Expect(json.Unmarshal(res.Body.Bytes(), &letter)).To(Succeed())
+		Expect(letter.Payload).To(Equal("a"))
+	})
+
+	It("deletes a letter", func() {
+		Expect(request("DELETE", "/deadLetters/1").Code).To(Equal(http.StatusNoContent))
+		Expect(request("GET", "/deadLetters/1").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("redrives a letter", func() {
+		Expect(request("POST", "/deadLetters/1/redrive").Code).To(Equal(http.StatusNoContent))
+		Expect(queue.List("")).To(HaveLen(1))
+	})
+
+	It("reports letters that cannot be redriven", func() {
+		Expect(request("POST", "/deadLetters/2/redrive").Code).To(Equal(http.StatusConflict))
+	})
+
+	It("rejects unknown paths and methods", func() {
+		Expect(request("GET", "/deadLetters/x").Code).To(Equal(http.StatusNotFound))
+		Expect(request("GET", "/deadLetters/1/other").Code).To(Equal(http.StatusNotFound))
+		Expect(request("POST", "/deadLetters").Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(request("PUT", "/deadLetters/1").Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
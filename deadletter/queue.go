@@ -0,0 +1,209 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cromega/clogger"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/utils"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultCapacity = 100
+
+var logger clogger.Logger
+
+var ErrNotFound = errors.New("No such dead letter")
+
+func init() {
+	logger = utils.CreateLogger()
+}
+
+// Letter is a message that failed at a stage of the bridge
+type Letter struct {
+	Id      uint64    `json:"id"`
+	Stage   string    `json:"stage"`
+	Payload string    `json:"payload"`
+	Error   string    `json:"error"`
+	Time    time.Time `json:"time"`
+}
+
+// Handler hands the payload of a redriven letter back to its stage
+type Handler func(payload string) error
+
+// Queue keeps the latest letters up to its capacity, in a file when it has
+// a path so they survive restarts
+type Queue struct {
+	lock     sync.Mutex
+	path     string
+	capacity int
+	state    queueState
+	handlers map[string]Handler
+	now      func() time.Time
+}
+
+type queueState struct {
+	NextId  uint64   `json:"nextId"`
+	Letters []Letter `json:"letters"`
+}
+
+// Open loads the queue stored at path, or starts an empty one. An empty path
+// keeps the letters in memory only.
+func Open(path string, capacity int) (*Queue, error) {
+	queue := &Queue{
+		path:     path,
+		capacity: capacity,
+		state:    queueState{NextId: 1},
+		handlers: make(map[string]Handler),
+		now:      time.Now,
+	}
+	if path == "" {
+		return queue, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return queue, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read dead letters: %v", err)
+	}
+	if err := json.Unmarshal(data, &queue.state); err != nil {
+		return nil, fmt.Errorf("Could not parse dead letters %v: %v", path, err)
+	}
+	return queue, nil
+}
+
+// Handle sets how letters of a stage are redriven
+func (self *Queue) Handle(stage string, handler Handler) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.handlers[stage] = handler
+}
+
+// Add records a failed message, dropping the oldest letter when the queue
+// is full
+func (self *Queue) Add(stage, payload string, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	letter := Letter{Id: self.state.NextId, Stage: stage, Payload: payload, Error: err.Error(), Time: self.now()}
+	self.state.NextId++
+	self.insert(letter)
+	self.persist()
+}
+
+func (self *Queue) insert(letter Letter) {
+	if self.capacity <= 0 {
+		return
+	}
+	if len(self.state.Letters) >= self.capacity {
+		self.state.Letters = self.state.Letters[len(self.state.Letters)-self.capacity+1:]
+	}
+	self.state.Letters = append(self.state.Letters, letter)
+}
+
+// List returns the letters of a stage, or all of them for an empty stage,
+// oldest first
+func (self *Queue) List(stage string) []Letter {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	letters := []Letter{}
+	for _, letter := range self.state.Letters {
+		if stage == "" || letter.Stage == stage {
+			letters = append(letters, letter)
+		}
+	}
+	return letters
+}
+
+func (self *Queue) Get(id uint64) (Letter, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	index := self.find(id)
+	if index < 0 {
+		return Letter{}, ErrNotFound
+	}
+	return self.state.Letters[index], nil
+}
+
+func (self *Queue) Delete(id uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	_, err := self.remove(id)
+	return err
+}
+
+// Redrive takes a letter out of the queue and hands it back to its stage. A
+// letter that cannot be handed back stays in the queue; one that fails
+// again at its stage comes back as a new letter.
+func (self *Queue) Redrive(id uint64) error {
+	self.lock.Lock()
+	letter, err := self.remove(id)
+	handler := self.handlers[letter.Stage]
+	self.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if handler == nil {
+		err = fmt.Errorf("Letters of stage %v cannot be redriven", letter.Stage)
+	} else {
+		err = handler(letter.Payload)
+	}
+	if err != nil {
+		self.lock.Lock()
+		self.insert(letter)
+		self.persist()
+		self.lock.Unlock()
+		return err
+	}
+
+	logger.Info("Redrove dead letter %v to %v", letter.Id, letter.Stage)
+	return nil
+}
+
+func (self *Queue) find(id uint64) int {
+	for i, letter := range self.state.Letters {
+		if letter.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (self *Queue) remove(id uint64) (Letter, error) {
+	index := self.find(id)
+	if index < 0 {
+		return Letter{}, ErrNotFound
+	}
+
+	letter := self.state.Letters[index]
+	self.state.Letters = append(self.state.Letters[:index], self.state.Letters[index+1:]...)
+	self.persist()
+	return letter, nil
+}
+
+// persist replaces the queue's file; failures are logged as the letters
+// are still kept in memory
+func (self *Queue) persist() {
+	if self.path == "" {
+		return
+	}
+
+	data, _ := json.Marshal(self.state)
+	temporary := self.path + ".tmp"
+	err := ioutil.WriteFile(temporary, data, 0600)
+	if err == nil {
+		err = os.Rename(temporary, self.path)
+	}
+	if err != nil {
+		logger.Error("Could not store dead letters: %v", err)
+	}
+}
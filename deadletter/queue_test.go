@@ -0,0 +1,142 @@
+package deadletter
+
+import (
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Queue", func() {
+	var queue *Queue
+
+	BeforeEach(func() {
+		queue, _ = Open("", 10)
+	})
+
+	It("records the stage, payload and error of failed messages", func() {
+		queue.Add("stage", "payload", errors.New("broken"))
+
+		letters := queue.List("")
+		Expect(letters).To(HaveLen(1))
+		Expect(letters[0].Id).To(BeEquivalentTo(1))
+		Expect(letters[0].Stage).To(Equal("stage"))
+		Expect(letters[0].Payload).To(Equal("payload"))
+		Expect(letters[0].Error).To(Equal("broken"))
+		Expect(letters[0].Time.IsZero()).To(BeFalse())
+	})
+
+	It("lists the letters of a stage", func() {
+		queue.Add("one", "a", errors.New("broken"))
+		queue.Add("two", "b", errors.New("broken"))
+
+		Expect(queue.List("two")).To(HaveLen(1))
+		Expect(queue.List("two")[0].Payload).To(Equal("b"))
+	})
+
+	It("drops the oldest letters beyond its capacity", func() {
+		queue, _ = Open("", 2)
+		queue.Add("stage", "a", errors.New("broken"))
+		queue.Add("stage", "b", errors.New("broken"))
+		queue.Add("stage", "c", errors.New("broken"))
+
+		letters := queue.List("")
+		Expect(letters).To(HaveLen(2))
+		Expect(letters[0].Payload).To(Equal("b"))
+		Expect(letters[1].Id).To(BeEquivalentTo(3))
+	})
+
+	It("gets and deletes letters", func() {
+		queue.Add("stage", "a", errors.New("broken"))
+
+		letter, err := queue.Get(1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(letter.Payload).To(Equal("a"))
+
+		Expect(queue.Delete(1)).To(Succeed())
+		Expect(queue.Delete(1)).To(Equal(ErrNotFound))
+		_, err = queue.Get(1)
+		Expect(err).To(Equal(ErrNotFound))
+	})
+
+	Describe("redriving", func() {
+		var redriven []string
+
+		BeforeEach(func() {
+			redriven = nil
+			queue.Handle("stage", func(payload string) error {
+				redriven = append(redriven, payload)
+				return nil
+			})
+		})
+
+		It("hands the payload back to its stage and removes the letter", func() {
+			queue.Add("stage", "a", errors.New("broken"))
+
+			Expect(queue.Redrive(1)).To(Succeed())
+			Expect(redriven).To(Equal([]string{"a"}))
+			Expect(queue.List("")).To(BeEmpty())
+		})
+
+		It("keeps letters that cannot be handed back", func() {
+			queue.Handle("stage", func(string) error { return errors.New("still broken") })
+			queue.Add("stage", "a", errors.New("broken"))
+
+			Expect(queue.Redrive(1)).To(MatchError("still broken"))
+			Expect(queue.List("")).To(HaveLen(1))
+		})
+
+		It("keeps letters of stages without a handler", func() {
+			queue.Add("other", "a", errors.New("broken"))
+
+			Expect(queue.Redrive(1)).NotTo(Succeed())
+			Expect(queue.List("")).To(HaveLen(1))
+		})
+
+		It("does not know letters that are not queued", func() {
+			Expect(queue.Redrive(1)).To(Equal(ErrNotFound))
+		})
+	})
+
+	Describe("persistence", func() {
+		var dir, path string
+
+		BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "deadletter")
+			path = filepath.Join(dir, "letters.json")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("starts empty without a file", func() {
+			queue, err := Open(path, 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(queue.List("")).To(BeEmpty())
+		})
+
+		It("keeps letters and ids across restarts", func() {
+			queue, _ := Open(path, 10)
+			queue.Add("stage", "a", errors.New("broken"))
+			queue.Add("stage", "b", errors.New("broken"))
+			queue.Delete(2)
+
+			reopened, err := Open(path, 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reopened.List("")).To(HaveLen(1))
+
+			reopened.Add("stage", "c", errors.New("broken"))
+			Expect(reopened.List("")[1].Id).To(BeEquivalentTo(3))
+		})
+
+		It("rejects a corrupt file", func() {
+			ioutil.WriteFile(path, []byte("{"), 0600)
+
+			_, err := Open(path, 10)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
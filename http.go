@@ -1,14 +1,25 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
 	"net/http"
 	"os"
 	"runtime"
+	"strings"
 )
 
-func setupHttp(reporters map[string]reporter.StatusReporter) {
+// adminTokenVariable names the environment variable with the token that
+// requests changing the bridge must carry
+const adminTokenVariable = "ADMIN_TOKEN"
+
+// secretVariables are parts of the names of environment variables whose
+// values /env does not show
+var secretVariables = []string{"PASSWORD", "KEY", "TOKEN"}
+
+func setupHttp(reporters map[string]reporter.StatusReporter, adminToken string) {
 	http.Handle("/", http.FileServer(http.Dir("public")))
 	http.HandleFunc("/env", env)
 
@@ -28,6 +39,33 @@ func setupHttp(reporters map[string]reporter.StatusReporter) {
 		}
 	})
 
+	http.HandleFunc("/deviceStats", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(lrscClient.deviceStats())
+	})
+
+	http.HandleFunc("/downlinks", func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(lrscClient.downlinks.list())
+	})
+
+	http.Handle("/downlinks/", authorized(adminToken, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "DELETE" {
+			http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		correlationId := strings.TrimPrefix(req.URL.Path, "/downlinks/")
+		if !lrscClient.cancelCommand(correlationId) {
+			http.NotFound(res, req)
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	})))
+
+	http.Handle("/deadLetters", authorized(adminToken, deadLetters))
+	http.Handle("/deadLetters/", authorized(adminToken, deadLetters))
+
 	http.HandleFunc("/stack", func(res http.ResponseWriter, req *http.Request) {
 		data := make([]byte, 100000)
 		all := true
@@ -36,6 +74,23 @@ func setupHttp(reporters map[string]reporter.StatusReporter) {
 	})
 }
 
+// authorized lets requests that change the bridge through only with the
+// admin token as their bearer token, and none without a token configured
+func authorized(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" && !hasToken(req, token) {
+			http.Error(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
+
+func hasToken(req *http.Request, token string) bool {
+	given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
 func startHttp() error {
 	return http.ListenAndServe(":"+os.Getenv("PORT"), nil)
 }
@@ -43,6 +98,18 @@ func startHttp() error {
 func env(res http.ResponseWriter, req *http.Request) {
 	res.Header().Set("Content-Type", "text/plain")
 	for key, value := range os.Environ() {
-		fmt.Fprintf(res, "%v = %v\n", key, value)
+		fmt.Fprintf(res, "%v = %v\n", key, hideSecret(value))
+	}
+}
+
+// hideSecret hides the value of a NAME=value variable whose name looks
+// like it holds a secret
+func hideSecret(variable string) string {
+	name := strings.SplitN(variable, "=", 2)[0]
+	for _, secret := range secretVariables {
+		if strings.Contains(strings.ToUpper(name), secret) {
+			return name + "=<hidden>"
+		}
 	}
+	return variable
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"os"
+)
+
+var _ = Describe("HTTP API", func() {
+	request := func(method, token string) int {
+		handler := authorized("secret", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.WriteHeader(http.StatusNoContent)
+		}))
+
+		req, _ := http.NewRequest(method, "/deadLetters/1", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	It("lets reads through without a token", func() {
+		Expect(request("GET", "")).To(Equal(http.StatusNoContent))
+	})
+
+	It("lets changes through only with the admin token", func() {
+		Expect(request("DELETE", "")).To(Equal(http.StatusUnauthorized))
+		Expect(request("POST", "wrong")).To(Equal(http.StatusUnauthorized))
+		Expect(request("DELETE", "secret")).To(Equal(http.StatusNoContent))
+	})
+
+	It("lets no changes through without an admin token configured", func() {
+		req, _ := http.NewRequest("DELETE", "/deadLetters/1", nil)
+		req.Header.Set("Authorization", "Bearer ")
+		Expect(hasToken(req, "")).To(BeFalse())
+	})
+
+	Describe("/env", func() {
+		It("hides the values of variables holding secrets", func() {
+			os.Setenv("LRSC_KEYSTORE_PASSWORD", "keystore-secret")
+			os.Setenv(adminTokenVariable, "admin-secret")
+			defer os.Unsetenv("LRSC_KEYSTORE_PASSWORD")
+			defer os.Unsetenv(adminTokenVariable)
+
+			res := httptest.NewRecorder()
+			env(res, nil)
+
+			Expect(res.Body.String()).To(ContainSubstring("LRSC_KEYSTORE_PASSWORD=<hidden>"))
+			Expect(res.Body.String()).To(ContainSubstring("ADMIN_TOKEN=<hidden>"))
+			Expect(res.Body.String()).ToNot(ContainSubstring("keystore-secret"))
+			Expect(res.Body.String()).ToNot(ContainSubstring("admin-secret"))
+		})
+
+		It("shows the values of other variables", func() {
+			Expect(hideSecret("LRSC_HOST=localhost")).To(Equal("LRSC_HOST=localhost"))
+			Expect(hideSecret("IOTF_API_KEY=a=b")).To(Equal("IOTF_API_KEY=<hidden>"))
+		})
+	})
+})
@@ -1,18 +1,21 @@
 package iotf
 
 import (
-	"github.com/pborman/uuid"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/pborman/uuid"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/mqtt"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
 	"regexp"
+	"sync/atomic"
 )
 
 type broker interface {
 	connect() error
 	statusReporter() reporter.StatusReporter
-	publishMessageFromDevice(Event)
+	publishMessageFromDevice(Event) error
 }
 
 type iotfBroker struct {
@@ -22,6 +25,7 @@ type iotfBroker struct {
 	deviceType    string
 	clientFactory clientFactory
 	clientId      string
+	online        int32
 }
 
 func newIoTFBroker(credentials *Credentials, commands chan<- bridge.Command, errChan chan<- error, deviceType string, clientFactory clientFactory) *iotfBroker {
@@ -47,24 +51,60 @@ func (b *iotfBroker) connect() error {
 		return err
 	}
 	b.Report("SUBSCRIPTION", "OK")
+	atomic.StoreInt32(&b.online, 1)
 	return nil
 }
 
+// disconnected stops publishing on the client until it is connected again
+func (self *iotfBroker) disconnected() {
+	atomic.StoreInt32(&self.online, 0)
+}
+
 func (self *iotfBroker) statusReporter() reporter.StatusReporter {
 	return self.StatusReporter
 }
 
-func (self *iotfBroker) publishMessageFromDevice(event Event) {
-	topic := fmt.Sprintf("iot-2/type/%v/id/%v/evt/TEST/fmt/json", self.deviceType, event.Device)
+func (self *iotfBroker) publishMessageFromDevice(event Event) error {
+	if atomic.LoadInt32(&self.online) == 0 {
+		return errors.New("not connected to IoTF")
+	}
+
+	name := event.Name
+	if name == "" {
+		name = "TEST"
+	}
+
+	topic := fmt.Sprintf("iot-2/type/%v/id/%v/evt/%v/fmt/json", self.deviceType, event.Device, name)
 	logger.Debug("publishing event on topic %v: %v", topic, event)
-	self.client.PublishMessage(topic, []byte(event.Payload))
+	if err := self.client.PublishMessage(topic, []byte(event.Payload)); err != nil {
+		return err
+	}
+
+	if event.Radio != nil {
+		self.publishRadioMetadata(event.Device, event.Radio)
+	}
+	return nil
+}
+
+func (self *iotfBroker) publishRadioMetadata(device string, radio *RadioMetadata) {
+	payload, err := json.Marshal(radio)
+	if err != nil {
+		logger.Error("could not encode radio metadata for %v: %v", device, err)
+		return
+	}
+
+	topic := fmt.Sprintf("iot-2/type/%v/id/%v/evt/radio/fmt/json", self.deviceType, device)
+	if err := self.client.PublishMessage(topic, payload); err != nil {
+		logger.Error("could not publish radio metadata for %v: %v", device, err)
+	}
 }
 
 func (self *iotfBroker) subscribeToCommandMessages(commands chan<- bridge.Command) error {
 	topic := fmt.Sprintf("iot-2/type/%s/id/+/cmd/+/fmt/json", self.deviceType)
 	return self.client.StartSubscription(topic, func(message mqtt.Message) {
 		device := extractDeviceFromCommandTopic(message.Topic())
-		command := bridge.Command{Device: device, Payload: string(message.Payload())}
+		name := extractCommandNameFromTopic(message.Topic())
+		command := parseCommand(device, name, message.Payload())
 		logger.Debug("received command message for %v", command.Device)
 		commands <- command
 	})
@@ -74,3 +114,8 @@ func extractDeviceFromCommandTopic(topic string) string {
 	topicMatcher := regexp.MustCompile(`^iot-2/type/.*?/id/(.*?)/`)
 	return topicMatcher.FindStringSubmatch(topic)[1]
 }
+
+func extractCommandNameFromTopic(topic string) string {
+	topicMatcher := regexp.MustCompile(`^iot-2/type/.*?/id/.*?/cmd/(.*?)/`)
+	return topicMatcher.FindStringSubmatch(topic)[1]
+}
@@ -69,6 +69,12 @@ var _ = Describe("IoTF Broker", func() {
 			connection.connect()
 		})
 
+		It("does not publish while disconnected", func() {
+			connection.disconnected()
+			Expect(connection.publishMessageFromDevice(Event{Device: "foo", Payload: "message"})).NotTo(Succeed())
+			Expect(client.messages).To(BeEmpty())
+		})
+
 		It("sends a message with the correct topic", func() {
 			connection.publishMessageFromDevice(Event{Device: "foo", Payload: "message"})
 			Expect(client.messages[0].Topic()).To(Equal("iot-2/type/test/id/foo/evt/TEST/fmt/json"))
@@ -78,6 +84,25 @@ var _ = Describe("IoTF Broker", func() {
 			connection.publishMessageFromDevice(Event{Device: "foo", Payload: "message"})
 			Expect(client.messages[0].Payload()).To(Equal([]byte("message")))
 		})
+
+		It("publishes radio metadata alongside the payload", func() {
+			radio := &RadioMetadata{Gateway: "gw", Rssi: -97, Snr: 7.5, Frequency: 868100000, DataRate: "SF7BW125", Port: 5, SequenceNumber: 12}
+			connection.publishMessageFromDevice(Event{Device: "foo", Payload: "message", Radio: radio})
+
+			Expect(client.messages).To(HaveLen(2))
+			Expect(client.messages[1].Topic()).To(Equal("iot-2/type/test/id/foo/evt/radio/fmt/json"))
+			Expect(client.messages[1].Payload()).To(MatchJSON(`{"gateway":"gw","rssi":-97,"snr":7.5,"frequency":868100000,"dataRate":"SF7BW125","port":5,"seqno":12}`))
+		})
+
+		It("publishes on the event's name", func() {
+			connection.publishMessageFromDevice(Event{Device: "foo", Name: "commandStatus", Payload: "{}"})
+			Expect(client.messages[0].Topic()).To(Equal("iot-2/type/test/id/foo/evt/commandStatus/fmt/json"))
+		})
+
+		It("publishes no radio metadata when there is none", func() {
+			connection.publishMessageFromDevice(Event{Device: "foo", Payload: "message"})
+			Expect(client.messages).To(HaveLen(1))
+		})
 	})
 
 	Describe("SubscribeToCommandMessages", func() {
@@ -97,6 +122,12 @@ var _ = Describe("IoTF Broker", func() {
 			client.fakePublish("command")
 			Expect((<-commandChannel).Device).To(Equal("mydevice"))
 		})
+
+		It("extracts the command name from the mqtt topic", func() {
+			connection.subscribeToCommandMessages(commandChannel)
+			client.fakePublish("command")
+			Expect((<-commandChannel).Name).To(Equal("test"))
+		})
 	})
 
 })
@@ -108,6 +139,13 @@ var _ = Describe("extractDeviceFromCommandTopic", func() {
 	})
 })
 
+var _ = Describe("extractCommandNameFromTopic", func() {
+	It("returns the command name", func() {
+		topic := "iot-2/type/foo/id/devid/cmd/command/fmt/json"
+		Expect(extractCommandNameFromTopic(topic)).To(Equal("command"))
+	})
+})
+
 type mockClientFactory struct {
 	client mqtt.Client
 }
@@ -137,8 +175,9 @@ func (self *mockClient) Start() error {
 	return nil
 }
 
-func (self *mockClient) PublishMessage(topic string, payload []byte) {
+func (self *mockClient) PublishMessage(topic string, payload []byte) error {
 	self.messages = append(self.messages, message{topic, payload})
+	return nil
 }
 
 func (self *mockClient) StartSubscription(_ string, callback func(message mqtt.Message)) error {
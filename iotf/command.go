@@ -0,0 +1,81 @@
+package iotf
+
+import (
+	"encoding/json"
+	"github.com/pborman/uuid"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"time"
+)
+
+// commandEnvelope is the optional JSON wrapper around a command payload
+// that carries delivery options, e.g.
+//
+//	{"payload": "0102", "confirmed": true, "timeout": 30, "ttl": 600,
+//	 "priority": "high", "idempotencyKey": "valve-42"}
+//
+// Commands that are not wrapped are forwarded as they are.
+type commandEnvelope struct {
+	Payload        json.RawMessage `json:"payload"`
+	Confirmed      bool            `json:"confirmed"`
+	Timeout        uint            `json:"timeout"`
+	CorrelationId  string          `json:"correlationId"`
+	Ttl            uint            `json:"ttl"`
+	Priority       string          `json:"priority"`
+	IdempotencyKey string          `json:"idempotencyKey"`
+}
+
+const highPriority = "high"
+
+type commandStatus struct {
+	Command       string                   `json:"command"`
+	CorrelationId string                   `json:"correlationId"`
+	Status        bridge.CommandStatus     `json:"status"`
+	Reason        string                   `json:"reason,omitempty"`
+	Rejection     *bridge.CommandRejection `json:"rejection,omitempty"`
+}
+
+const commandStatusEvent = "commandStatus"
+
+func parseCommand(device, name string, payload []byte) bridge.Command {
+	command := bridge.Command{Device: device, Name: name, Payload: string(payload), CorrelationId: uuid.New()}
+
+	var envelope commandEnvelope
+	if json.Unmarshal(payload, &envelope) != nil || envelope.Payload == nil {
+		return command
+	}
+
+	if envelope.CorrelationId != "" {
+		command.CorrelationId = envelope.CorrelationId
+	}
+
+	var text string
+	if json.Unmarshal(envelope.Payload, &text) == nil {
+		command.Payload = text
+	} else {
+		command.Payload = string(envelope.Payload)
+	}
+	command.Confirmed = envelope.Confirmed
+	command.Timeout = envelope.Timeout
+	command.HighPriority = envelope.Priority == highPriority
+	command.IdempotencyKey = envelope.IdempotencyKey
+	if envelope.Ttl > 0 {
+		command.Expires = time.Now().Add(time.Duration(envelope.Ttl) * time.Second)
+	}
+
+	return command
+}
+
+// NewCommandStatusEvent describes the progress of a command in an event
+// published for the command's device
+func NewCommandStatusEvent(result bridge.CommandResult) Event {
+	status := commandStatus{
+		Command:       result.Command.Name,
+		CorrelationId: result.Command.CorrelationId,
+		Status:        result.Status,
+		Reason:        result.Reason,
+		Rejection:     result.Rejection,
+	}
+	payload, _ := json.Marshal(status)
+
+	return Event{Device: result.Command.Device, Name: commandStatusEvent, Payload: string(payload)}
+}
@@ -0,0 +1,83 @@
+package iotf
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"time"
+)
+
+var _ = Describe("parseCommand", func() {
+	It("forwards plain payloads unchanged", func() {
+		command := parseCommand("dev", "switch", []byte("0102"))
+		Expect(command.Device).To(Equal("dev"))
+		Expect(command.Name).To(Equal("switch"))
+		Expect(command.Payload).To(Equal("0102"))
+	})
+
+	It("forwards JSON payloads without an envelope unchanged", func() {
+		Expect(parseCommand("dev", "switch", []byte(`{"on":true}`)).Payload).To(Equal(`{"on":true}`))
+	})
+
+	It("unwraps the payload of an envelope", func() {
+		Expect(parseCommand("dev", "switch", []byte(`{"payload":"0102"}`)).Payload).To(Equal("0102"))
+	})
+
+	It("keeps JSON payloads inside an envelope as JSON", func() {
+		command := parseCommand("dev", "switch", []byte(`{"payload":{"on":true}}`))
+		Expect(command.Payload).To(MatchJSON(`{"on":true}`))
+	})
+
+	It("reads the delivery options", func() {
+		command := parseCommand("dev", "switch", []byte(`{"payload":"0102","confirmed":true,"timeout":30}`))
+		Expect(command.Confirmed).To(BeTrue())
+		Expect(command.Timeout).To(BeEquivalentTo(30))
+	})
+
+	It("reads the queueing options", func() {
+		command := parseCommand("dev", "switch", []byte(`{"payload":"0102","ttl":60,"priority":"high","idempotencyKey":"k"}`))
+		Expect(command.HighPriority).To(BeTrue())
+		Expect(command.IdempotencyKey).To(Equal("k"))
+		Expect(command.Expires).To(BeTemporally("~", time.Now().Add(time.Minute), time.Second))
+	})
+
+	It("never expires commands without a TTL", func() {
+		command := parseCommand("dev", "switch", []byte(`{"payload":"0102","priority":"normal"}`))
+		Expect(command.Expires.IsZero()).To(BeTrue())
+		Expect(command.HighPriority).To(BeFalse())
+	})
+
+	Describe("correlation id", func() {
+		It("uses the one from the envelope", func() {
+			command := parseCommand("dev", "switch", []byte(`{"payload":"0102","correlationId":"abc"}`))
+			Expect(command.CorrelationId).To(Equal("abc"))
+		})
+
+		It("generates a unique one otherwise", func() {
+			first := parseCommand("dev", "switch", []byte("0102"))
+			second := parseCommand("dev", "switch", []byte("0102"))
+			Expect(first.CorrelationId).ToNot(BeEmpty())
+			Expect(first.CorrelationId).ToNot(Equal(second.CorrelationId))
+		})
+	})
+})
+
+var _ = Describe("NewCommandStatusEvent", func() {
+	It("describes the command's progress", func() {
+		command := bridge.Command{Device: "dev", Name: "switch", CorrelationId: "abc"}
+		event := NewCommandStatusEvent(bridge.CommandResult{Command: command, Status: bridge.CommandFailed, Reason: "nack"})
+
+		Expect(event.Device).To(Equal("dev"))
+		Expect(event.Name).To(Equal("commandStatus"))
+		Expect(event.Payload).To(MatchJSON(`{"command":"switch","correlationId":"abc","status":"failed","reason":"nack"}`))
+	})
+
+	It("details rejections", func() {
+		command := bridge.Command{Device: "dev", Name: "switch", CorrelationId: "abc"}
+		rejection := &bridge.CommandRejection{Code: bridge.RejectionPayloadTooLarge, DataRate: "SF12BW125", Length: 60, MaxLength: 51}
+		event := NewCommandStatusEvent(bridge.CommandResult{Command: command, Status: bridge.CommandRejected, Reason: "too long", Rejection: rejection})
+
+		Expect(event.Payload).To(MatchJSON(`{"command":"switch","correlationId":"abc","status":"rejected","reason":"too long",
+			"rejection":{"code":"payloadTooLarge","dataRate":"SF12BW125","length":60,"maxLength":51}}`))
+	})
+})
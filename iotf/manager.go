@@ -8,6 +8,9 @@ import (
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/utils"
+	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
 var logger clogger.Logger
@@ -21,10 +24,32 @@ type IoTFManager struct {
 	deviceRegistrar deviceRegistrar
 	events          <-chan Event
 	errChan         chan error
+	deadLetters     bridge.DeadLetters
+
+	// outbox keeps the events that could not be published, in order
+	outbox     *Outbox
+	publishing sync.Mutex
+	looping    int32
 }
 
 type Event struct {
 	Device, Payload string
+	Radio           *RadioMetadata
+
+	// Name is the IoTF event id, TEST when empty
+	Name string
+}
+
+// RadioMetadata describes how an uplink was received, for diagnosing
+// link quality and coverage
+type RadioMetadata struct {
+	Gateway        string  `json:"gateway"`
+	Rssi           float64 `json:"rssi"`
+	Snr            float64 `json:"snr"`
+	Frequency      uint64  `json:"frequency"`
+	DataRate       string  `json:"dataRate"`
+	Port           uint    `json:"port"`
+	SequenceNumber uint64  `json:"seqno"`
 }
 
 type Credentials struct {
@@ -37,31 +62,128 @@ type Credentials struct {
 	MqttUnsecurePort int    `json:"mqtt_u_port"`
 }
 
-func NewIoTFManager(vcapServices string, commands chan<- bridge.Command, events <-chan Event, deviceType string) (*IoTFManager, error) {
+// NewIoTFManager creates a manager that publishes events and receives
+// commands. Events of devices IoTF refuses to register go to deadLetters,
+// events that cannot be registered or published yet wait in outbox.
+func NewIoTFManager(vcapServices string, commands chan<- bridge.Command, events <-chan Event, deviceType string, deadLetters bridge.DeadLetters, outbox *Outbox) (*IoTFManager, error) {
 	iotfCreds, err := extractCredentials(vcapServices)
 	if err != nil {
 		return nil, err
 	}
 
 	errChan := make(chan error)
+	var broker *iotfBroker
 	clientFactory := &mqttClientFactory{credentials: *iotfCreds, connectionLostHandler: func(err error) {
 		logger.Error("IoTF connection lost handler called: " + err.Error())
+		broker.disconnected()
 		errChan <- errors.New("IoTF connection lost handler called: " + err.Error())
 	}}
 
-	broker := newIoTFBroker(iotfCreds, commands, errChan, deviceType, clientFactory)
+	if outbox == nil {
+		outbox, _ = OpenOutbox("", DefaultOutboxSize, DefaultOutboxMaxAge)
+	}
+
+	broker = newIoTFBroker(iotfCreds, commands, errChan, deviceType, clientFactory)
 	deviceRegistrar := newIotfHttpRegistrar(iotfCreds, deviceType)
-	return &IoTFManager{broker: broker, deviceRegistrar: deviceRegistrar, events: events, errChan: errChan}, nil
+	return &IoTFManager{broker: broker, deviceRegistrar: deviceRegistrar, events: events, errChan: errChan, deadLetters: deadLetters, outbox: outbox}, nil
 }
 
+// Connect connects to IoTF and then publishes the events buffered while
+// it was unreachable
 func (self *IoTFManager) Connect() error {
-	return self.broker.connect()
+	if err := self.broker.connect(); err != nil {
+		return err
+	}
+
+	self.drain()
+	return nil
 }
 
+// Loop publishes the events. It is started after every connect, but as it
+// buffers the events while IoTF is unreachable only the first call loops,
+// the later ones return at once.
 func (self *IoTFManager) Loop() {
+	if !atomic.CompareAndSwapInt32(&self.looping, 0, 1) {
+		return
+	}
+
 	for event := range self.events {
-		self.deviceRegistrar.registerDevice(event.Device)
-		self.broker.publishMessageFromDevice(event)
+		self.forward(event)
+	}
+}
+
+// forward delivers an event, or buffers it behind those waiting already.
+// The buffered events are retried first, as IoTF may be reachable again.
+func (self *IoTFManager) forward(event Event) {
+	self.publishing.Lock()
+	defer self.publishing.Unlock()
+
+	if self.outbox.depth() > 0 {
+		self.publishBuffered()
+	}
+
+	if self.outbox.depth() == 0 {
+		err := self.deliver(event)
+		if err == nil {
+			self.reportOutbox()
+			return
+		}
+		logger.Warning("Buffering events until IoTF is reachable again: %v", err)
+	}
+
+	self.outbox.push(event)
+	self.reportOutbox()
+}
+
+// drain publishes the buffered events in order until one fails
+func (self *IoTFManager) drain() {
+	self.publishing.Lock()
+	defer self.publishing.Unlock()
+
+	if err := self.publishBuffered(); err != nil {
+		logger.Error("Could not publish buffered events: %v", err)
+	}
+	self.reportOutbox()
+}
+
+func (self *IoTFManager) publishBuffered() error {
+	for {
+		event, buffered := self.outbox.peek()
+		if !buffered {
+			return nil
+		}
+		if err := self.deliver(event); err != nil {
+			return err
+		}
+		self.outbox.pop()
+	}
+}
+
+// deliver registers the device of an event and publishes it. An event of a
+// device IoTF refuses is dead-lettered, as retrying it would block the rest.
+func (self *IoTFManager) deliver(event Event) error {
+	if err := self.deviceRegistrar.registerDevice(event.Device); err != nil {
+		if _, rejected := err.(registrationRejected); !rejected {
+			return err
+		}
+		self.deadLetter(event, err)
+		return nil
+	}
+
+	return self.broker.publishMessageFromDevice(event)
+}
+
+func (self *IoTFManager) reportOutbox() {
+	status := self.broker.statusReporter()
+	status.Report("QUEUE_DEPTH", strconv.Itoa(self.outbox.depth()))
+	status.Report("QUEUE_DROPPED", strconv.FormatUint(self.outbox.droppedCount(), 10))
+}
+
+func (self *IoTFManager) deadLetter(event Event, err error) {
+	logger.Error("Could not register device %v, dropping its %v event: %v", event.Device, event.Name, err)
+	if self.deadLetters != nil {
+		payload, _ := json.Marshal(event)
+		self.deadLetters.Add(bridge.StageIoTFRegistration, string(payload), err)
 	}
 }
 
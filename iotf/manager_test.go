@@ -1,19 +1,30 @@
 package iotf
 
 import (
+	"encoding/json"
 	"errors"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
+	"sync"
 	"time"
 )
 
 var (
+	// mockLock guards callOrder and the state of the mocks, which the
+	// manager's loop uses while the tests look at them
+	mockLock  sync.Mutex
 	callOrder []string
 )
 
+func calls() []string {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+	return append([]string{}, callOrder...)
+}
+
 var _ = Describe("IotfManager", func() {
 	var (
 		vcapServices string
@@ -44,6 +55,7 @@ var _ = Describe("IotfManager", func() {
 		mockDeviceRegistrar *mockDeviceRegistrar
 		eventsChannel       chan Event
 		errorsChannel       chan error
+		deadLetters         *mockDeadLetters
 	)
 
 	BeforeEach(func() {
@@ -51,13 +63,16 @@ var _ = Describe("IotfManager", func() {
 		eventsChannel = make(chan Event)
 		errorsChannel = make(chan error)
 
-		iotfManager, _ = NewIoTFManager(vcapServices, commandsChannel, eventsChannel, "test")
+		deadLetters = &mockDeadLetters{}
+		iotfManager, _ = NewIoTFManager(vcapServices, commandsChannel, eventsChannel, "test", deadLetters, nil)
 
 		mockBroker = newMockBroker()
 		mockDeviceRegistrar = newMockDeviceRegistrar()
 		iotfManager.broker = mockBroker
 		iotfManager.deviceRegistrar = mockDeviceRegistrar
+		mockLock.Lock()
 		callOrder = make([]string, 0)
+		mockLock.Unlock()
 	})
 
 	AfterEach(func() {
@@ -92,7 +107,7 @@ var _ = Describe("IotfManager", func() {
 				}
 			}
 
-			Expect(len(mockBroker.events)).To(Equal(5))
+			Eventually(func() int { return len(mockBroker.published()) }).Should(Equal(5))
 		})
 
 		Context("when an event is received", func() {
@@ -105,7 +120,7 @@ var _ = Describe("IotfManager", func() {
 				case <-time.After(time.Millisecond * 1):
 				}
 
-				Expect(mockBroker.events).To(Equal([]Event{event}))
+				Eventually(mockBroker.published).Should(Equal([]Event{event}))
 			})
 		})
 
@@ -119,8 +134,7 @@ var _ = Describe("IotfManager", func() {
 				case <-time.After(time.Millisecond * 1):
 				}
 
-				_, devicePresent := mockDeviceRegistrar.devices["unseen"]
-				Expect(devicePresent).To(BeTrue())
+				Eventually(func() bool { return mockDeviceRegistrar.deviceRegistered("unseen") }).Should(BeTrue())
 			})
 
 			It("registers the device before it publishes the message", func() {
@@ -132,11 +146,128 @@ var _ = Describe("IotfManager", func() {
 				case <-time.After(time.Millisecond * 1):
 				}
 
-				Expect(callOrder).To(Equal([]string{"registerDevice", "publishMessageFromDevice"}))
+				Eventually(calls).Should(Equal([]string{"registerDevice", "publishMessageFromDevice"}))
+			})
+
+			It("dead-letters events of devices IoTF refuses to register", func() {
+				mockDeviceRegistrar.reject = true
+				go iotfManager.Loop()
+
+				event := Event{Device: "unseen", Payload: "message", Name: "status"}
+				eventsChannel <- event
+
+				Eventually(deadLetters.added).Should(Equal([]string{bridge.StageIoTFRegistration}))
+				Expect(mockBroker.published()).To(BeEmpty())
+
+				var dropped Event
+				Expect(json.Unmarshal([]byte(deadLetters.payload(0)), &dropped)).To(Succeed())
+				Expect(dropped).To(Equal(event))
 			})
+
+			It("buffers events of devices that cannot be registered while IoTF is unreachable", func() {
+				mockDeviceRegistrar.connect = true
+				go iotfManager.Loop()
+
+				eventsChannel <- Event{Device: "unseen", Payload: "message"}
+
+				Eventually(iotfManager.outbox.depth).Should(Equal(1))
+				Expect(deadLetters.added()).To(BeEmpty())
+			})
+		})
+
+	})
+	Describe("buffering while IoTF is unreachable", func() {
+		send := func(devices ...string) {
+			for _, device := range devices {
+				eventsChannel <- Event{Device: device}
+			}
+		}
+
+		published := func() (devices []string) {
+			for _, event := range mockBroker.published() {
+				devices = append(devices, event.Device)
+			}
+			return devices
+		}
+
+		BeforeEach(func() {
+			mockBroker.connected = true
+			mockBroker.publishFail = true
+			go iotfManager.Loop()
+		})
+
+		It("buffers the events that cannot be published", func() {
+			send("a", "b")
+
+			Eventually(iotfManager.outbox.depth).Should(Equal(2))
+			Expect(mockBroker.published()).To(BeEmpty())
+			Expect(mockBroker.reporter.Summary()).To(ContainSubstring(`"QUEUE_DEPTH":"2"`))
+		})
+
+		It("publishes the buffered events in order once connected again", func() {
+			send("a", "b")
+			Eventually(iotfManager.outbox.depth).Should(Equal(2))
+
+			mockBroker.setPublishFail(false)
+			Expect(iotfManager.Connect()).To(Succeed())
+
+			Expect(published()).To(Equal([]string{"a", "b"}))
+			Expect(iotfManager.outbox.depth()).To(Equal(0))
+			Expect(mockBroker.reporter.Summary()).To(ContainSubstring(`"QUEUE_DEPTH":"0"`))
+		})
+
+		It("keeps new events behind the buffered ones", func() {
+			send("a", "b")
+			Eventually(iotfManager.outbox.depth).Should(Equal(2))
+			Expect(mockBroker.published()).To(BeEmpty())
 		})
 
+		It("retries the buffered events before publishing new ones", func() {
+			send("a")
+			Eventually(iotfManager.outbox.depth).Should(Equal(1))
+
+			mockBroker.setPublishFail(false)
+			send("b")
+			Eventually(published).Should(Equal([]string{"a", "b"}))
+			Expect(iotfManager.outbox.depth()).To(Equal(0))
+			Expect(mockBroker.reporter.Summary()).To(ContainSubstring(`"QUEUE_DEPTH":"0"`))
+		})
+
+		It("only consumes the events once across reconnects", func() {
+			mockBroker.setPublishFail(false)
+			go iotfManager.Loop()
+			send("a", "b", "c")
+
+			Eventually(published).Should(Equal([]string{"a", "b", "c"}))
+		})
+
+		It("returns at once from Loop when it is looping already", func() {
+			mockBroker.setPublishFail(false)
+			send("a")
+			Eventually(published).Should(Equal([]string{"a"}))
+
+			looped := make(chan struct{})
+			go func() {
+				iotfManager.Loop()
+				close(looped)
+			}()
+			Eventually(looped).Should(BeClosed())
+		})
+
+		It("registers the devices of buffered events before publishing them", func() {
+			mockDeviceRegistrar.setConnect(true)
+			send("a")
+			Eventually(iotfManager.outbox.depth).Should(Equal(1))
+
+			mockDeviceRegistrar.setConnect(false)
+			mockBroker.setPublishFail(false)
+			Expect(iotfManager.Connect()).To(Succeed())
+
+			Expect(published()).To(Equal([]string{"a"}))
+			Expect(mockDeviceRegistrar.deviceRegistered("a")).To(BeTrue())
+		})
 	})
+
 	Describe("Error", func() {
 		It("returns the managers read-only error channel", func() {
 			var errChan <-chan error = iotfManager.errChan
@@ -146,13 +277,15 @@ var _ = Describe("IotfManager", func() {
 })
 
 type mockBroker struct {
-	connected bool
-	events    []Event
+	connected   bool
+	publishFail bool
+	events      []Event
+	reporter    reporter.StatusReporter
 }
 
 func newMockBroker() *mockBroker {
 	events := make([]Event, 0)
-	return &mockBroker{events: events}
+	return &mockBroker{events: events, reporter: reporter.New()}
 }
 
 func (self *mockBroker) connect() error {
@@ -163,17 +296,58 @@ func (self *mockBroker) connect() error {
 }
 
 func (self *mockBroker) statusReporter() reporter.StatusReporter {
-	return nil
+	return self.reporter
 }
 
-func (self *mockBroker) publishMessageFromDevice(event Event) {
+func (self *mockBroker) publishMessageFromDevice(event Event) error {
+	mockLock.Lock()
+	defer mockLock.Unlock()
 	callOrder = append(callOrder, "publishMessageFromDevice")
+	if self.publishFail {
+		return errors.New("not connected")
+	}
 	self.events = append(self.events, event)
+	return nil
+}
+
+func (self *mockBroker) published() []Event {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+	return append([]Event{}, self.events...)
+}
+
+func (self *mockBroker) setPublishFail(fail bool) {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+	self.publishFail = fail
+}
+
+type mockDeadLetters struct {
+	stages, payloads []string
+}
+
+func (self *mockDeadLetters) Add(stage, payload string, err error) {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+	self.stages = append(self.stages, stage)
+	self.payloads = append(self.payloads, payload)
+}
+
+func (self *mockDeadLetters) added() []string {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+	return append([]string{}, self.stages...)
+}
+
+func (self *mockDeadLetters) payload(index int) string {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+	return self.payloads[index]
 }
 
 type mockDeviceRegistrar struct {
-	connect bool
-	devices map[string]struct{}
+	connect, reject bool
+	devices         map[string]struct{}
 }
 
 func newMockDeviceRegistrar() *mockDeviceRegistrar {
@@ -181,16 +355,29 @@ func newMockDeviceRegistrar() *mockDeviceRegistrar {
 }
 
 func (self *mockDeviceRegistrar) registerDevice(deviceId string) error {
+	mockLock.Lock()
+	defer mockLock.Unlock()
 	callOrder = append(callOrder, "registerDevice")
 	if self.connect {
 		return errors.New("")
 	}
+	if self.reject {
+		return registrationRejected{status: 400}
+	}
 
 	self.devices[deviceId] = struct{}{}
 	return nil
 }
 
+func (self *mockDeviceRegistrar) setConnect(connect bool) {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+	self.connect = connect
+}
+
 func (self *mockDeviceRegistrar) deviceRegistered(deviceId string) bool {
+	mockLock.Lock()
+	defer mockLock.Unlock()
 	_, present := self.devices[deviceId]
 	return present
 }
@@ -0,0 +1,211 @@
+package iotf
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOutboxSize   = 10000
+	DefaultOutboxMaxAge = 24 * time.Hour
+)
+
+// Outbox buffers the events that cannot be published while IoTF is
+// unreachable. With a path, the events are appended to a file, one JSON
+// line each, so they survive restarts. Removing the oldest event appends a
+// removal line, and the file is rewritten once it holds more removed events
+// than remaining ones. The oldest events are dropped when
+// the outbox is full, and events are dropped when they get older than
+// maxAge.
+type Outbox struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	size    int
+	maxAge  time.Duration
+	entries []outboxEntry
+	// the number of removal lines in the file
+	removed int
+	dropped uint64
+	now     func() time.Time
+}
+
+type outboxEntry struct {
+	Time  time.Time `json:"time"`
+	Event Event     `json:"event"`
+}
+
+type outboxLine struct {
+	outboxEntry
+	Removed bool `json:"removed"`
+}
+
+var outboxRemoval = []byte("{\"removed\":true}\n")
+
+// OpenOutbox loads the events buffered at path; an empty path keeps them
+// in memory only
+func OpenOutbox(path string, size int, maxAge time.Duration) (*Outbox, error) {
+	outbox := &Outbox{path: path, size: size, maxAge: maxAge, now: time.Now}
+	if path == "" {
+		return outbox, nil
+	}
+
+	file, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var line outboxLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				logger.Error("Skipping unreadable event in %v: %v", path, err)
+				continue
+			}
+			if line.Removed {
+				if len(outbox.entries) > 0 {
+					outbox.entries = outbox.entries[1:]
+				}
+				continue
+			}
+			outbox.entries = append(outbox.entries, line.outboxEntry)
+		}
+		err = scanner.Err()
+		file.Close()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Could not read outbox: %v", err)
+	}
+
+	outbox.expire()
+	for len(outbox.entries) > size {
+		outbox.drop()
+	}
+	if err := outbox.compact(); err != nil {
+		return nil, fmt.Errorf("Could not write outbox: %v", err)
+	}
+	return outbox, nil
+}
+
+// push buffers an event behind the others, making room if needed
+func (self *Outbox) push(event Event) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.size <= 0 {
+		self.dropped++
+		return
+	}
+	for len(self.entries) >= self.size {
+		self.drop()
+	}
+
+	entry := outboxEntry{Time: self.now(), Event: event}
+	self.entries = append(self.entries, entry)
+	if self.file != nil {
+		line, _ := json.Marshal(entry)
+		if _, err := self.file.Write(append(line, '\n')); err != nil {
+			logger.Error("Could not store event in outbox: %v", err)
+		}
+	}
+}
+
+// peek returns the oldest event that has not expired
+func (self *Outbox) peek() (Event, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.expire()
+	if len(self.entries) == 0 {
+		return Event{}, false
+	}
+	return self.entries[0].Event, true
+}
+
+// pop removes the oldest event once it was published
+func (self *Outbox) pop() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.entries) > 0 {
+		self.remove()
+	}
+}
+
+func (self *Outbox) depth() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.entries)
+}
+
+func (self *Outbox) droppedCount() uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.dropped
+}
+
+func (self *Outbox) expire() {
+	for len(self.entries) > 0 && self.maxAge > 0 && self.now().Sub(self.entries[0].Time) > self.maxAge {
+		self.drop()
+	}
+}
+
+func (self *Outbox) drop() {
+	logger.Warning("Dropping buffered %v event of %v", self.entries[0].Event.Name, self.entries[0].Event.Device)
+	self.dropped++
+	self.remove()
+}
+
+func (self *Outbox) remove() {
+	self.entries = self.entries[1:]
+	self.removed++
+
+	if self.path == "" {
+		return
+	}
+	if self.removed >= len(self.entries) {
+		if err := self.compact(); err != nil {
+			logger.Error("Could not compact outbox: %v", err)
+		}
+		return
+	}
+	if self.file != nil {
+		if _, err := self.file.Write(outboxRemoval); err != nil {
+			logger.Error("Could not remove event from outbox: %v", err)
+		}
+	}
+}
+
+// compact rewrites the file with the remaining entries only
+func (self *Outbox) compact() error {
+	if self.file != nil {
+		self.file.Close()
+		self.file = nil
+	}
+
+	temporary := self.path + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, entry := range self.entries {
+		line, _ := json.Marshal(entry)
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(temporary, self.path); err != nil {
+		file.Close()
+		return err
+	}
+
+	self.file = file
+	self.removed = 0
+	return nil
+}
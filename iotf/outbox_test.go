@@ -0,0 +1,118 @@
+package iotf
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Outbox", func() {
+	var (
+		outbox *Outbox
+		now    time.Time
+	)
+
+	drain := func(outbox *Outbox) (devices []string) {
+		for {
+			event, buffered := outbox.peek()
+			if !buffered {
+				return devices
+			}
+			devices = append(devices, event.Device)
+			outbox.pop()
+		}
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+		outbox, _ = OpenOutbox("", 3, time.Hour)
+		outbox.now = func() time.Time { return now }
+	})
+
+	It("returns the events in order", func() {
+		outbox.push(Event{Device: "a"})
+		outbox.push(Event{Device: "b"})
+
+		Expect(outbox.depth()).To(Equal(2))
+		Expect(drain(outbox)).To(Equal([]string{"a", "b"}))
+		Expect(outbox.depth()).To(Equal(0))
+	})
+
+	It("drops the oldest events when full", func() {
+		for _, device := range []string{"a", "b", "c", "d"} {
+			outbox.push(Event{Device: device})
+		}
+
+		Expect(outbox.droppedCount()).To(BeEquivalentTo(1))
+		Expect(drain(outbox)).To(Equal([]string{"b", "c", "d"}))
+	})
+
+	It("drops events older than the maximum age", func() {
+		outbox.push(Event{Device: "a"})
+		now = now.Add(30 * time.Minute)
+		outbox.push(Event{Device: "b"})
+		now = now.Add(31 * time.Minute)
+
+		Expect(drain(outbox)).To(Equal([]string{"b"}))
+		Expect(outbox.droppedCount()).To(BeEquivalentTo(1))
+	})
+
+	Describe("on disk", func() {
+		var dir, path string
+
+		BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "outbox")
+			path = filepath.Join(dir, "outbox.json")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("keeps the events across restarts", func() {
+			outbox, err := OpenOutbox(path, 10, time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+			outbox.push(Event{Device: "a", Name: "status", Payload: "{}"})
+			outbox.push(Event{Device: "b"})
+			outbox.push(Event{Device: "c"})
+			outbox.pop()
+
+			reopened, err := OpenOutbox(path, 10, time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(drain(reopened)).To(Equal([]string{"b", "c"}))
+		})
+
+		It("removes published events from the file", func() {
+			outbox, _ := OpenOutbox(path, 10, time.Hour)
+			outbox.push(Event{Device: "a"})
+			outbox.push(Event{Device: "b"})
+			drain(outbox)
+
+			data, _ := ioutil.ReadFile(path)
+			Expect(data).To(BeEmpty())
+		})
+
+		It("applies the limits to the stored events", func() {
+			outbox, _ := OpenOutbox(path, 10, time.Hour)
+			outbox.push(Event{Device: "a"})
+			outbox.push(Event{Device: "b"})
+			outbox.push(Event{Device: "c"})
+
+			reopened, _ := OpenOutbox(path, 2, time.Hour)
+			Expect(drain(reopened)).To(Equal([]string{"b", "c"}))
+		})
+
+		It("skips unreadable events", func() {
+			lines := []string{`{"event":{"Device":"a"},"time":"2100-01-01T00:00:00Z"}`, `{`}
+			ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600)
+
+			outbox, err := OpenOutbox(path, 10, time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(outbox.depth()).To(Equal(1))
+		})
+	})
+})
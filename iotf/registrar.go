@@ -1,7 +1,6 @@
 package iotf
 
 import (
-	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -12,6 +11,16 @@ type deviceRegistrar interface {
 	deviceRegistered(deviceId string) bool
 }
 
+// registrationRejected is returned when IoTF refuses to register a device,
+// so retrying the registration will not help
+type registrationRejected struct {
+	status int
+}
+
+func (self registrationRejected) Error() string {
+	return fmt.Sprintf("Unable to create device, %d", self.status)
+}
+
 type iotfHttpRegistrar struct {
 	credentials       *Credentials
 	devicesRegistered map[string]struct{}
@@ -38,7 +47,11 @@ func (self *iotfHttpRegistrar) registerDevice(deviceId string) error {
 	request.Header.Add("Content-Type", "application/json")
 
 	client := &http.Client{}
-	response, _ := client.Do(request)
+	response, err := client.Do(request)
+	if err != nil {
+		logger.Error("Unable to register device: %v", err)
+		return fmt.Errorf("Unable to create device, %v", err)
+	}
 	defer response.Body.Close()
 
 	switch response.StatusCode {
@@ -48,9 +61,15 @@ func (self *iotfHttpRegistrar) registerDevice(deviceId string) error {
 	case http.StatusConflict:
 		logger.Warning("Device %v was already registered", deviceId)
 		break
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		logger.Error("Unable to register device (http %v)", response.StatusCode)
+		return fmt.Errorf("Unable to create device, %d", response.StatusCode)
 	default:
 		logger.Error("Unable to register device (http %v)", response.StatusCode)
-		return errors.New(fmt.Sprintf("Unable to create device, %d", response.StatusCode))
+		if response.StatusCode >= 400 && response.StatusCode < 500 {
+			return registrationRejected{status: response.StatusCode}
+		}
+		return fmt.Errorf("Unable to create device, %d", response.StatusCode)
 	}
 
 	self.devicesRegistered[deviceId] = struct{}{}
@@ -95,6 +95,20 @@ var _ = Describe("Registrar", func() {
 				)
 				err := registrar.registerDevice("")
 				Expect(err).To(HaveOccurred())
+				Expect(err).ToNot(BeAssignableToTypeOf(registrationRejected{}))
+			})
+		})
+
+		Context("IoTF refuses the device", func() {
+			It("returns a rejection", func() {
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("POST", registrationPath),
+						ghttp.RespondWith(http.StatusBadRequest, nil, nil),
+					),
+				)
+				err := registrar.registerDevice("")
+				Expect(err).To(Equal(registrationRejected{status: http.StatusBadRequest}))
 			})
 		})
 
@@ -0,0 +1,221 @@
+package keystore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Credentials holds the PEM encoded client certificate, client key and CA
+// certificate found in an LRSC key archive
+type Credentials struct {
+	Eui         string
+	Certificate []byte
+	Key         []byte
+	CA          []byte
+}
+
+var clientFileMatcher = regexp.MustCompile(`^((?:[0-9A-Fa-f]{2}-){7}[0-9A-Fa-f]{2})\.CLIENT\.`)
+
+// Load reads the key archive downloaded from the LRSC web interface. The
+// archive can be a zip file, a tar.gz file or a directory it was extracted
+// to. When eui is empty, the archive must contain the keys of a single client.
+func Load(path, eui, password string) (*Credentials, error) {
+	files, err := readArchive(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read key archive %v: %v", path, err)
+	}
+
+	if eui == "" {
+		eui, err = findEui(files)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	credentials := &Credentials{Eui: eui}
+
+	// the keystores are only opened for what the PEM files lack, so that
+	// archives with both need no password
+	cert, hasCert := files[eui+".CLIENT.cert"]
+	key, hasKey := files[eui+".CLIENT.key"]
+	keyStoreFile, hasKeyStore := files[eui+".CLIENT.key.jks"]
+	var keyStore *KeyStore
+	if hasKeyStore && (!hasCert || !hasKey) {
+		keyStore, err = ParseJKS(keyStoreFile, password)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %v.CLIENT.key.jks: %v", eui, err)
+		}
+	}
+
+	if hasCert {
+		credentials.Certificate = cert
+	} else if keyStore != nil && len(keyStore.PrivateKeys) > 0 {
+		credentials.Certificate = encodeCertificates(keyStore.PrivateKeys[0].Chain)
+	} else {
+		return nil, fmt.Errorf("Could not find a client certificate for %v in the key archive", eui)
+	}
+
+	if hasKey {
+		credentials.Key = key
+	} else if keyStore != nil && len(keyStore.PrivateKeys) > 0 {
+		credentials.Key = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyStore.PrivateKeys[0].Key})
+	} else {
+		return nil, fmt.Errorf("Could not find a client key for %v in the key archive", eui)
+	}
+
+	if ca, present := files["CA.cert"]; present {
+		credentials.CA = ca
+	} else if ca, present := files["CA.cert.der"]; present {
+		credentials.CA = encodeCertificates([][]byte{ca})
+	} else if trustStoreFile, present := files[eui+".CLIENT.cert.trust.jks"]; present {
+		trustStore, err := ParseJKS(trustStoreFile, password)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %v.CLIENT.cert.trust.jks: %v", eui, err)
+		}
+		credentials.CA = encodeCertificates(trustStore.TrustedCertificates)
+	}
+
+	return credentials, nil
+}
+
+func findEui(files map[string][]byte) (string, error) {
+	found := make(map[string]struct{})
+	for name := range files {
+		match := clientFileMatcher.FindStringSubmatch(name)
+		if match != nil {
+			found[match[1]] = struct{}{}
+		}
+	}
+
+	euis := []string{}
+	for eui := range found {
+		euis = append(euis, eui)
+	}
+	sort.Strings(euis)
+
+	switch len(euis) {
+	case 0:
+		return "", errors.New("Could not find any client keys in the key archive")
+	case 1:
+		return euis[0], nil
+	default:
+		return "", fmt.Errorf("Key archive contains keys for several clients (%v), set LRSC_EUI to choose one", strings.Join(euis, ", "))
+	}
+}
+
+func encodeCertificates(certificates [][]byte) []byte {
+	encoded := []byte{}
+	for _, certificate := range certificates {
+		encoded = append(encoded, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})...)
+	}
+	return encoded
+}
+
+// readArchive returns the contents of every file in the archive, keyed by
+// base name; the certs/ and private/ folders never contain clashing names
+func readArchive(path string) (map[string][]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case info.IsDir():
+		return readDirectory(path)
+	case strings.HasSuffix(path, ".zip"):
+		return readZip(path)
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return readTarGz(path)
+	default:
+		return nil, errors.New("unsupported archive format, expected a directory, .zip or .tar.gz")
+	}
+}
+
+func readDirectory(path string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		files[filepath.Base(name)] = data
+		return nil
+	})
+	return files, err
+}
+
+func readZip(path string) (map[string][]byte, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	files := make(map[string][]byte)
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.Base(file.Name)] = data
+	}
+	return files, nil
+}
+
+func readTarGz(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	uncompressed, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	archive := tar.NewReader(uncompressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.Base(header.Name)] = data
+	}
+}
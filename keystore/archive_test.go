@@ -0,0 +1,167 @@
+package keystore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const testEui = "AA-AA-AA-AA-FF-FF-FF-FF"
+
+var _ = Describe("Load", func() {
+	var (
+		files map[string][]byte
+		dir   string
+	)
+
+	BeforeEach(func() {
+		key, certificate := newTestKeyPair("client")
+		_, ca := newTestKeyPair("ca")
+
+		// like the archives LRSC ships, with PEM files and keystores side by side
+		files = map[string][]byte{
+			"certs/" + testEui + ".CLIENT.cert":           pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}),
+			"certs/" + testEui + ".CLIENT.cert.trust.jks": encodeTestJKS("secret", nil, [][]byte{ca}),
+			"certs/" + testEui + ".cert":                  []byte("server certificate"),
+			"certs/CA.cert":                               pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca}),
+			"certs/CA.cert.der":                           ca,
+			"private/" + testEui + ".CLIENT.key":          pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}),
+			"private/" + testEui + ".CLIENT.key.jks":      encodeTestJKS("secret", []PrivateKeyEntry{{Alias: "client", Key: key, Chain: [][]byte{certificate}}}, nil),
+		}
+		dir, _ = ioutil.TempDir("", "lrsc-archive")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	expectCredentials := func(credentials *Credentials, err error) {
+		Expect(err).ToNot(HaveOccurred())
+		Expect(credentials.Eui).To(Equal(testEui))
+		Expect(credentials.Certificate).To(Equal(files["certs/"+testEui+".CLIENT.cert"]))
+		Expect(credentials.Key).To(Equal(files["private/"+testEui+".CLIENT.key"]))
+		Expect(credentials.CA).To(Equal(files["certs/CA.cert"]))
+	}
+
+	It("needs no password when the PEM files are present", func() {
+		expectCredentials(Load(writeTestDirectory(dir, files), "", "wrong"))
+	})
+
+	It("reads an extracted directory", func() {
+		expectCredentials(Load(writeTestDirectory(dir, files), "", ""))
+	})
+
+	It("reads a zip archive", func() {
+		expectCredentials(Load(writeTestZip(dir, files), "", ""))
+	})
+
+	It("reads a tar.gz archive", func() {
+		expectCredentials(Load(writeTestTarGz(dir, files), "", ""))
+	})
+
+	It("rejects other files", func() {
+		path := filepath.Join(dir, "keys.rar")
+		ioutil.WriteFile(path, []byte{}, 0600)
+
+		_, err := Load(path, "", "")
+		Expect(err).To(MatchError(ContainSubstring("unsupported archive format")))
+	})
+
+	It("falls back to the DER encoded CA", func() {
+		delete(files, "certs/CA.cert")
+
+		credentials, err := Load(writeTestDirectory(dir, files), "", "")
+		Expect(err).ToNot(HaveOccurred())
+		ca, _ := pem.Decode(credentials.CA)
+		Expect(ca.Bytes).To(Equal(files["certs/CA.cert.der"]))
+	})
+
+	Context("with keys for several clients", func() {
+		BeforeEach(func() {
+			files["certs/BB-BB-BB-BB-FF-FF-FF-FF.CLIENT.cert"] = []byte("other")
+		})
+
+		It("asks for the EUI", func() {
+			_, err := Load(writeTestDirectory(dir, files), "", "")
+			Expect(err).To(MatchError(ContainSubstring("LRSC_EUI")))
+		})
+
+		It("uses the configured EUI", func() {
+			expectCredentials(Load(writeTestDirectory(dir, files), testEui, ""))
+		})
+	})
+
+	Context("with Java keystores only", func() {
+		BeforeEach(func() {
+			key, _ := pem.Decode(files["private/"+testEui+".CLIENT.key"])
+			certificate, _ := pem.Decode(files["certs/"+testEui+".CLIENT.cert"])
+			ca, _ := pem.Decode(files["certs/CA.cert"])
+
+			files = map[string][]byte{
+				"private/" + testEui + ".CLIENT.key.jks":      encodeTestJKS("secret", []PrivateKeyEntry{{Alias: "client", Key: key.Bytes, Chain: [][]byte{certificate.Bytes}}}, nil),
+				"certs/" + testEui + ".CLIENT.cert.trust.jks": encodeTestJKS("secret", nil, [][]byte{ca.Bytes}),
+			}
+		})
+
+		It("reads the key, certificate and CA from the keystores", func() {
+			credentials, err := Load(writeTestDirectory(dir, files), "", "secret")
+			Expect(err).ToNot(HaveOccurred())
+
+			key, _ := pem.Decode(credentials.Key)
+			Expect(key.Type).To(Equal("PRIVATE KEY"))
+			Expect(credentials.Certificate).ToNot(BeEmpty())
+			Expect(credentials.CA).ToNot(BeEmpty())
+		})
+
+		It("fails with the wrong password", func() {
+			_, err := Load(writeTestDirectory(dir, files), "", "wrong")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+func writeTestDirectory(dir string, files map[string][]byte) string {
+	root := filepath.Join(dir, "keys")
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		ioutil.WriteFile(path, data, 0600)
+	}
+	return root
+}
+
+func writeTestZip(dir string, files map[string][]byte) string {
+	path := filepath.Join(dir, "keys.zip")
+	file, _ := os.Create(path)
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	for name, data := range files {
+		writer, _ := archive.Create(name)
+		writer.Write(data)
+	}
+	archive.Close()
+	return path
+}
+
+func writeTestTarGz(dir string, files map[string][]byte) string {
+	path := filepath.Join(dir, "keys.tar.gz")
+	file, _ := os.Create(path)
+	defer file.Close()
+
+	compressed := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressed)
+	for name, data := range files {
+		archive.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		archive.Write(data)
+	}
+	archive.Close()
+	compressed.Close()
+	return path
+}
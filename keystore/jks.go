@@ -0,0 +1,232 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	jksMagic = 0xFEEDFEED
+
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+
+	jksIntegritySalt = "Mighty Aphrodite"
+)
+
+// the OID of Sun's proprietary key protection algorithm used by JKS
+var jksKeyProtectorOid = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// KeyStore is the content of a Java keystore (JKS) file
+type KeyStore struct {
+	PrivateKeys         []PrivateKeyEntry
+	TrustedCertificates [][]byte
+}
+
+// PrivateKeyEntry is a PKCS#8 DER encoded private key and its DER encoded
+// certificate chain
+type PrivateKeyEntry struct {
+	Alias string
+	Key   []byte
+	Chain [][]byte
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm struct {
+		Algorithm  asn1.ObjectIdentifier
+		Parameters asn1.RawValue `asn1:"optional"`
+	}
+	EncryptedData []byte
+}
+
+// ParseJKS reads a JKS keystore, checks its integrity and decrypts the
+// private keys it contains with the given password
+func ParseJKS(data []byte, password string) (*KeyStore, error) {
+	if len(data) < sha1.Size {
+		return nil, errors.New("keystore is truncated")
+	}
+
+	body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	if !bytes.Equal(jksIntegrityDigest(body, password), digest) {
+		return nil, errors.New("keystore password is incorrect or the keystore is corrupt")
+	}
+
+	reader := bytes.NewReader(body)
+
+	var header struct {
+		Magic, Version, Count uint32
+	}
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != jksMagic {
+		return nil, errors.New("not a JKS keystore")
+	}
+	if header.Version != 1 && header.Version != 2 {
+		return nil, fmt.Errorf("unsupported JKS version %v", header.Version)
+	}
+
+	keyStore := &KeyStore{}
+	for i := uint32(0); i < header.Count; i++ {
+		var tag uint32
+		if err := binary.Read(reader, binary.BigEndian, &tag); err != nil {
+			return nil, err
+		}
+
+		alias, err := readJksString(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		var timestamp uint64
+		if err := binary.Read(reader, binary.BigEndian, &timestamp); err != nil {
+			return nil, err
+		}
+
+		switch tag {
+		case jksPrivateKeyTag:
+			entry, err := readJksPrivateKey(reader, header.Version, password)
+			if err != nil {
+				return nil, fmt.Errorf("could not read key %v: %v", alias, err)
+			}
+			entry.Alias = alias
+			keyStore.PrivateKeys = append(keyStore.PrivateKeys, *entry)
+		case jksTrustedCertTag:
+			certificate, err := readJksCertificate(reader, header.Version)
+			if err != nil {
+				return nil, err
+			}
+			keyStore.TrustedCertificates = append(keyStore.TrustedCertificates, certificate)
+		default:
+			return nil, fmt.Errorf("unsupported keystore entry type %v", tag)
+		}
+	}
+
+	return keyStore, nil
+}
+
+func readJksPrivateKey(reader io.Reader, version uint32, password string) (*PrivateKeyEntry, error) {
+	encrypted, err := readJksBytes(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var chainLength uint32
+	if err := binary.Read(reader, binary.BigEndian, &chainLength); err != nil {
+		return nil, err
+	}
+
+	entry := &PrivateKeyEntry{}
+	for i := uint32(0); i < chainLength; i++ {
+		certificate, err := readJksCertificate(reader, version)
+		if err != nil {
+			return nil, err
+		}
+		entry.Chain = append(entry.Chain, certificate)
+	}
+
+	entry.Key, err = recoverJksKey(encrypted, password)
+	return entry, err
+}
+
+func readJksCertificate(reader io.Reader, version uint32) ([]byte, error) {
+	if version == 2 {
+		certificateType, err := readJksString(reader)
+		if err != nil {
+			return nil, err
+		}
+		if certificateType != "X.509" {
+			return nil, fmt.Errorf("unsupported certificate type %v", certificateType)
+		}
+	}
+	return readJksBytes(reader)
+}
+
+func readJksString(reader io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	return string(data), err
+}
+
+func readJksBytes(reader io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	return data, err
+}
+
+// recoverJksKey undoes the JKS key protector: the key is XORed with a SHA-1
+// keystream seeded by a salt and followed by a SHA-1 check of the plain text
+func recoverJksKey(protected []byte, password string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(protected, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(jksKeyProtectorOid) {
+		return nil, fmt.Errorf("unsupported key protection algorithm %v", info.Algorithm.Algorithm)
+	}
+
+	data := info.EncryptedData
+	if len(data) < 2*sha1.Size {
+		return nil, errors.New("protected key is truncated")
+	}
+
+	salt := data[:sha1.Size]
+	encrypted := data[sha1.Size : len(data)-sha1.Size]
+	check := data[len(data)-sha1.Size:]
+
+	passwordBytes := jksPassword(password)
+	key := make([]byte, len(encrypted))
+	digest := salt
+	for offset := 0; offset < len(encrypted); offset += sha1.Size {
+		hash := sha1.New()
+		hash.Write(passwordBytes)
+		hash.Write(digest)
+		digest = hash.Sum(nil)
+
+		for i := 0; i < sha1.Size && offset+i < len(encrypted); i++ {
+			key[offset+i] = encrypted[offset+i] ^ digest[i]
+		}
+	}
+
+	hash := sha1.New()
+	hash.Write(passwordBytes)
+	hash.Write(key)
+	if !bytes.Equal(hash.Sum(nil), check) {
+		return nil, errors.New("key password is incorrect")
+	}
+
+	return key, nil
+}
+
+func jksIntegrityDigest(body []byte, password string) []byte {
+	hash := sha1.New()
+	hash.Write(jksPassword(password))
+	hash.Write([]byte(jksIntegritySalt))
+	hash.Write(body)
+	return hash.Sum(nil)
+}
+
+// jksPassword encodes the password as UTF-16BE, the way Java hashes it
+func jksPassword(password string) []byte {
+	encoded := []byte{}
+	for _, unit := range utf16.Encode([]rune(password)) {
+		encoded = append(encoded, byte(unit>>8), byte(unit))
+	}
+	return encoded
+}
@@ -0,0 +1,152 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"math/big"
+	"time"
+)
+
+var _ = Describe("ParseJKS", func() {
+	var (
+		key, certificate []byte
+	)
+
+	BeforeEach(func() {
+		key, certificate = newTestKeyPair("client")
+	})
+
+	It("decrypts private keys and their certificate chain", func() {
+		data := encodeTestJKS("secret", []PrivateKeyEntry{{Alias: "client", Key: key, Chain: [][]byte{certificate}}}, nil)
+
+		keyStore, err := ParseJKS(data, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(keyStore.PrivateKeys).To(HaveLen(1))
+		Expect(keyStore.PrivateKeys[0].Alias).To(Equal("client"))
+		Expect(keyStore.PrivateKeys[0].Key).To(Equal(key))
+		Expect(keyStore.PrivateKeys[0].Chain).To(Equal([][]byte{certificate}))
+	})
+
+	It("reads trusted certificates", func() {
+		data := encodeTestJKS("secret", nil, [][]byte{certificate})
+
+		keyStore, err := ParseJKS(data, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(keyStore.TrustedCertificates).To(Equal([][]byte{certificate}))
+	})
+
+	It("decrypts keys longer than one keystream block", func() {
+		long := bytes.Repeat([]byte{0x42}, 3*sha1.Size+7)
+		data := encodeTestJKS("secret", []PrivateKeyEntry{{Alias: "client", Key: long}}, nil)
+
+		keyStore, err := ParseJKS(data, "secret")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(keyStore.PrivateKeys[0].Key).To(Equal(long))
+	})
+
+	It("rejects the wrong password", func() {
+		data := encodeTestJKS("secret", []PrivateKeyEntry{{Alias: "client", Key: key}}, nil)
+
+		_, err := ParseJKS(data, "wrong")
+		Expect(err).To(MatchError(ContainSubstring("password is incorrect")))
+	})
+
+	It("rejects files that are not keystores", func() {
+		_, err := ParseJKS([]byte("this is not a keystore at all"), "")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func newTestKeyPair(name string) (key, certificate []byte) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, _ = x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	key, _ = x509.MarshalPKCS8PrivateKey(privateKey)
+	return key, certificate
+}
+
+// encodeTestJKS writes a version 2 keystore the way Java's keytool does
+func encodeTestJKS(password string, keys []PrivateKeyEntry, trusted [][]byte) []byte {
+	buffer := &bytes.Buffer{}
+	write := func(v interface{}) { binary.Write(buffer, binary.BigEndian, v) }
+	writeString := func(s string) {
+		write(uint16(len(s)))
+		buffer.WriteString(s)
+	}
+	writeBytes := func(b []byte) {
+		write(uint32(len(b)))
+		buffer.Write(b)
+	}
+
+	write(uint32(jksMagic))
+	write(uint32(2))
+	write(uint32(len(keys) + len(trusted)))
+
+	for _, entry := range keys {
+		write(uint32(jksPrivateKeyTag))
+		writeString(entry.Alias)
+		write(uint64(0))
+		writeBytes(protectTestKey(entry.Key, password))
+		write(uint32(len(entry.Chain)))
+		for _, certificate := range entry.Chain {
+			writeString("X.509")
+			writeBytes(certificate)
+		}
+	}
+
+	for i, certificate := range trusted {
+		write(uint32(jksTrustedCertTag))
+		writeString(string(rune('a' + i)))
+		write(uint64(0))
+		writeString("X.509")
+		writeBytes(certificate)
+	}
+
+	buffer.Write(jksIntegrityDigest(buffer.Bytes(), password))
+	return buffer.Bytes()
+}
+
+func protectTestKey(key []byte, password string) []byte {
+	salt := make([]byte, sha1.Size)
+	rand.Read(salt)
+
+	passwordBytes := jksPassword(password)
+	encrypted := make([]byte, len(key))
+	digest := salt
+	for offset := 0; offset < len(key); offset += sha1.Size {
+		hash := sha1.New()
+		hash.Write(passwordBytes)
+		hash.Write(digest)
+		digest = hash.Sum(nil)
+		for i := 0; i < sha1.Size && offset+i < len(key); i++ {
+			encrypted[offset+i] = key[offset+i] ^ digest[i]
+		}
+	}
+
+	check := sha1.New()
+	check.Write(passwordBytes)
+	check.Write(key)
+
+	data := append(append(salt, encrypted...), check.Sum(nil)...)
+
+	var info encryptedPrivateKeyInfo
+	info.Algorithm.Algorithm = jksKeyProtectorOid
+	info.Algorithm.Parameters = asn1.RawValue{Tag: asn1.TagNull}
+	info.EncryptedData = data
+	encoded, _ := asn1.Marshal(info)
+	return encoded
+}
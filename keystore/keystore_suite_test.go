@@ -0,0 +1,13 @@
+package keystore
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestKeystore(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Keystore Suite")
+}
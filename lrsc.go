@@ -2,78 +2,120 @@ package main
 
 import (
 	"bufio"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/iotf"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
 	"io"
-	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
+	// the port of commands without a configured port
 	lrscDevicePort uint = 10
+
+	lrscClientEui     = "FF-00-00-00-00-00-00-00"
+	lrscProtocolMajor = 1
+	lrscProtocolMinor = 0
 )
 
+var euiMatcher = regexp.MustCompile(`^([0-9A-Fa-f]{2}-){7}[0-9A-Fa-f]{2}$`)
+
 type lrscConnection struct {
-	conn   io.ReadWriteCloser
-	reader *bufio.Reader
+	conn   transport
 	dialer dialer
 	reporter.StatusReporter
 	inbound        chan lrscMessage
 	err            chan error
 	sequenceNumber uint64
+	serverEui      string
+	version        string
+
+	unknownMessages   uint64
+	malformedMessages uint64
+	duplicates        uint64
+	pending           *pendingDownlinks
+	devices           *deviceConfig
+	dedup             *uplinkDeduplicator
+	frames            *frameCounters
+	deadLetters       bridge.DeadLetters
+
+	// downlinks holds the commands until their devices can receive them
+	downlinks *downlinkQueue
+	results   chan<- bridge.CommandResult
+	releasing sync.Mutex
+	connected int32
+
+	// radios, dutyCycle and payloadLimits follow the regional plan
+	radios        *deviceRadios
+	dutyCycle     *dutyCycleTracker
+	payloadLimits *payloadLimits
+	fragments     *fragmentSessions
 }
 
 type dialer interface {
-	dial() (io.ReadWriteCloser, error)
+	dial() (transport, error)
 	endpoint() string
 }
 
-type tlsDialer struct {
-	raddr      string
-	sslContext *tls.Config
-	reporter   *reporter.StatusReporter
+type transport interface {
+	open() error
+	readMessage() (string, error)
+	writeMessage(message string) error
+	Close() error
 }
 
-type dialerConfig struct {
-	host, port, cert, key string
+type lineTransport struct {
+	conn   io.ReadWriteCloser
+	reader *bufio.Reader
 }
 
-func (self *tlsDialer) dial() (io.ReadWriteCloser, error) {
-	return tls.Dial("tcp", self.raddr, self.sslContext)
+func createDialer(config dialerConfig, credentials *tlsCredentials) (dialer, error) {
+	switch config.transport {
+	case "", "tls":
+		return createTlsDialer(config, credentials), nil
+	case "websocket":
+		return createWebsocketDialer(config, credentials), nil
+	default:
+		return nil, fmt.Errorf("Unknown LRSC transport: %v", config.transport)
+	}
 }
 
-func (self *tlsDialer) endpoint() string {
-	return self.raddr
+func newLineTransport(conn io.ReadWriteCloser) *lineTransport {
+	return &lineTransport{conn: conn, reader: bufio.NewReader(conn)}
 }
 
-func createTlsDialer(config dialerConfig, reporter *reporter.StatusReporter) (dialer, error) {
-	cert, err := ioutil.ReadFile(config.cert)
-	if err != nil {
-		return nil, fmt.Errorf("Could not read client certificate: %v", err)
-	}
+func (self *lineTransport) open() error {
+	_, err := self.conn.Write([]byte("JSON_000"))
+	return err
+}
 
-	key, err := ioutil.ReadFile(config.key)
-	if err != nil {
-		return nil, fmt.Errorf("Could not read client key: %v", err)
-	}
+func (self *lineTransport) readMessage() (string, error) {
+	data, _, err := self.reader.ReadLine()
+	return string(data), err
+}
 
-	context := &tls.Config{InsecureSkipVerify: true}
-	certificate, err := tls.X509KeyPair(cert, key)
-	if err != nil {
-		return nil, err
-	}
+func (self *lineTransport) writeMessage(message string) error {
+	_, err := self.conn.Write([]byte(message + "\n\n"))
+	return err
+}
 
-	context.Certificates = []tls.Certificate{certificate}
-	endpoint := fmt.Sprintf("%v:%v", config.host, config.port)
-	return &tlsDialer{raddr: endpoint, sslContext: context, reporter: reporter}, nil
+func (self *lineTransport) Close() error {
+	return self.conn.Close()
 }
 
 func (self *lrscConnection) Connect() error {
 	err := self.establish()
+	if err == nil {
+		self.releaseQueuedDownlinks()
+	}
 	return err
 }
 
@@ -81,20 +123,88 @@ func (self *lrscConnection) Loop() {
 	for {
 		line, err := self.readLine()
 		if err != nil {
+			atomic.StoreInt32(&self.connected, 0)
 			self.err <- err
 			break
 		} else {
-			message, err := parseLrscMessage(string(line))
-			if err != nil {
-				self.err <- err
-				break
-			}
+			self.handleLine(line)
+		}
+	}
+}
 
-			self.inbound <- message
+// handleLine parses and dispatches a line received from LRSC, or from the
+// dead letters when it is redriven
+func (self *lrscConnection) handleLine(line string) {
+	message, err := decodeLrscMessage(line)
+	if unknown, ok := err.(unknownMessageTypeError); ok {
+		self.countUnknownMessage(unknown)
+		return
+	}
+	if err != nil {
+		self.quarantine(line, err)
+		return
+	}
+
+	self.dispatch(message)
+}
+
+func (self *lrscConnection) dispatch(message interface{}) {
+	switch message := message.(type) {
+	case *lrscMessage:
+		if message.Type != messageTypeUpstream {
+			logger.Warning("Ignoring unexpected downstream message for %v", message.DeviceGuid)
+			return
+		}
+		if self.dedup.duplicate(*message) {
+			self.countDuplicate(message)
+			return
 		}
+		self.radios.observeUplink(*message)
+		self.inbound <- *message
+		self.releaseAfterUplink(message.DeviceGuid)
+	case *lrscJoin:
+		logger.Info("Device %v joined with address %v", message.DeviceGuid, message.DevAddr)
+	case *lrscGatewayStatus:
+		status := "DISCONNECTED"
+		if message.Connected {
+			status = "CONNECTED"
+		}
+		logger.Info("Gateway %v is %v", message.GatewayEui, status)
+		self.Report("GATEWAY "+message.GatewayEui, status)
+	case *lrscError:
+		logger.Error("LRSC reported error %v: %v", message.Code, message.Message)
+		self.Report("LAST_ERROR", fmt.Sprintf("%v: %v", message.Code, message.Message))
+	case *lrscDownstreamResult:
+		logger.Debug("Downstream message %v for %v: msgtag %v", message.UniqueSequenceNo, message.DeviceGuid, message.Type)
+		self.pending.resolve(message)
+	default:
+		logger.Warning("Ignoring unexpected LRSC message %#v", message)
 	}
 }
 
+func (self *lrscConnection) countUnknownMessage(err unknownMessageTypeError) {
+	count := atomic.AddUint64(&self.unknownMessages, 1)
+	logger.Warning("Ignoring LRSC message: %v", err)
+	self.Report("UNKNOWN_MESSAGES", strconv.FormatUint(count, 10))
+}
+
+// quarantine keeps an unparsable line as a dead letter; only transport errors
+// warrant a reconnect
+func (self *lrscConnection) quarantine(line string, err error) {
+	count := atomic.AddUint64(&self.malformedMessages, 1)
+	logger.Error("Quarantining unparsable LRSC message %q: %v", line, err)
+	if self.deadLetters != nil {
+		self.deadLetters.Add(bridge.StageLrscParse, line, err)
+	}
+	self.Report("MALFORMED_MESSAGES", strconv.FormatUint(count, 10))
+}
+
+func (self *lrscConnection) countDuplicate(message *lrscMessage) {
+	count := atomic.AddUint64(&self.duplicates, 1)
+	logger.Debug("Dropping duplicate uplink %v from %v", message.UniqueSequenceNo, message.DeviceGuid)
+	self.Report("DUPLICATES", strconv.FormatUint(count, 10))
+}
+
 func (self *lrscConnection) Error() <-chan error {
 	return self.err
 }
@@ -106,93 +216,159 @@ func (self *lrscConnection) close() {
 }
 
 func (self *lrscConnection) establish() error {
+	atomic.StoreInt32(&self.connected, 0)
 	self.close()
 
-	logger.Debug("Attempting TCP connection")
+	logger.Debug("Attempting connection to %v", self.dialer.endpoint())
 	conn, err := self.dialer.dial()
 
 	if err != nil {
-		logger.Error("Could not establish TCP connection: %v", err)
+		logger.Error("Could not establish connection: %v", err)
 		self.Report("CONNECTION", err.Error())
 		return err
 	}
 	logger.Info("Connected to LRSC successfully")
 
 	self.conn = conn
-	self.reader = bufio.NewReader(self.conn)
 
 	err = self.handshake()
 	if err != nil {
 		logger.Error("Could not perform handshake: " + err.Error())
+		self.Report("CONNECTION", err.Error())
+		self.close()
 		return err
 	}
 
 	self.Report("CONNECTION", "OK")
+	atomic.StoreInt32(&self.connected, 1)
 	return nil
 }
 
 func (self *lrscConnection) handshake() error {
-	data := []byte("JSON_000")
-
-	_, err := self.conn.Write(data)
+	err := self.conn.open()
 	if err != nil {
 		logger.Debug("handshake failed: " + err.Error())
 		return err
 	}
 
-	hello := `{"msgtag":1,"eui":"FF-00-00-00-00-00-00-00","euidom":0,"major":1,"minor":0,"build":0,"name":"LRSC Client"}`
-	err = self.send(hello)
+	hello := lrscHandshake{
+		Type:  messageTypeHello,
+		Eui:   lrscClientEui,
+		Major: lrscProtocolMajor,
+		Minor: lrscProtocolMinor,
+		Name:  "LRSC Client",
+	}
+	helloJSON, err := json.Marshal(hello)
+	if err != nil {
+		return err
+	}
+
+	err = self.send(string(helloJSON))
 	if err != nil {
 		logger.Error("handshake failed: " + err.Error())
 		return err
 	}
 
-	handshake, err := self.readLine()
+	line, err := self.readLine()
 	if err != nil {
 		logger.Error("Did not receive ack in handshake: " + err.Error())
 		return err
 	}
 
-	if validateHandshake(handshake) {
-		logger.Info("handshake completed, connected to " + self.dialer.endpoint())
-	} else {
-		logger.Error("Failed to validate handshake response")
+	reply, err := parseLrscHandshake(line)
+	if err != nil {
+		return fmt.Errorf("Could not parse handshake reply: %v", err)
+	}
+
+	err = validateHandshake(reply, self.serverEui)
+	if err != nil {
+		logger.Error("Failed to validate handshake response: " + err.Error())
+		return err
 	}
 
+	self.version = negotiateVersion(reply, lrscProtocolMinor)
+	self.Report("VERSION", self.version)
+	logger.Info("handshake completed, connected to %v (%v, protocol version %v)", self.dialer.endpoint(), reply.Eui, self.version)
+
 	return nil
 }
 
 func (self *lrscConnection) send(message string) error {
-	data := []byte(message + "\n\n")
-
-	_, err := self.conn.Write(data)
+	err := self.conn.writeMessage(message)
 	if err == nil {
 		logger.Debug(">>> " + message)
 	}
 	return err
 }
 
-func (c *lrscConnection) incrementSequenceNumber() {
-	atomic.AddUint64(&c.sequenceNumber, 1)
+func (c *lrscConnection) incrementSequenceNumber() uint64 {
+	return atomic.AddUint64(&c.sequenceNumber, 1)
 }
 
 func (c *lrscConnection) sendCommand(v bridge.Command) error {
+	port := c.devices.commandPort(v.Device, v.Name)
+
+	pdu, err := c.devices.encodeCommand(v.Device, port, v.Payload)
+	if err != nil {
+		c.Report("ENCODE_ERROR", fmt.Sprintf("%v: %v", v.Device, err))
+		return commandEncodingError{err}
+	}
+
+	err = c.payloadLimits.check(v.Device, len(pdu)/2, !c.devices.waitsForUplink(v.Device))
+	if err != nil {
+		c.Report("PAYLOAD_SIZE", fmt.Sprintf("%v: %v", v.Device, err))
+		return err
+	}
+
+	return c.sendDownlink(v, port, pdu)
+}
+
+// sendDownlink sends the hex encoded pdu of a command on a port, within the
+// duty cycle
+func (c *lrscConnection) sendDownlink(v bridge.Command, port uint, pdu string) error {
 	message := convertCommandToLrscDownstreamMessage(v)
-	message.Port = lrscDevicePort
+	message.Port = port
+	message.Payload = pdu
+
+	airtime, err := c.dutyCycle.check(v.Device, len(pdu)/2, !c.devices.waitsForUplink(v.Device))
+	if err != nil {
+		c.Report("DUTY_CYCLE", err.Error())
+		return err
+	}
 
-	c.incrementSequenceNumber()
-	message.UniqueSequenceNo = c.sequenceNumber
+	message.UniqueSequenceNo = c.incrementSequenceNumber()
 
 	messageJSON, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
 
+	if message.Mode == messageModeConfirmed {
+		timeout := time.Duration(message.Timeout)*time.Second + confirmationGracePeriod
+		c.pending.add(message.UniqueSequenceNo, v, timeout)
+	}
+
 	err = c.send(string(messageJSON))
+	if err != nil && message.Mode == messageModeConfirmed {
+		c.pending.remove(message.UniqueSequenceNo)
+	}
+	if err == nil {
+		c.dutyCycle.record(airtime)
+	}
 
 	return err
 }
 
+// commandEncodingError rejects a command its codec cannot encode, however
+// often it is sent
+type commandEncodingError struct {
+	err error
+}
+
+func (self commandEncodingError) Error() string {
+	return fmt.Sprintf("Could not encode command: %v", self.err)
+}
+
 func convertCommandToLrscDownstreamMessage(v bridge.Command) lrscMessage {
 	message := lrscMessage{
 		Type:       messageTypeDownstream,
@@ -200,26 +376,96 @@ func convertCommandToLrscDownstreamMessage(v bridge.Command) lrscMessage {
 		Payload:    v.Payload,
 	}
 
+	if v.Confirmed {
+		message.Mode = messageModeConfirmed
+		message.Timeout = v.Timeout
+		if message.Timeout == 0 {
+			message.Timeout = defaultConfirmationTimeout
+		}
+	}
+
 	return message
 }
 
+func convertLrscUpstreamMessageToEvent(message lrscMessage) iotf.Event {
+	event := iotf.Event{Device: message.DeviceGuid, Payload: message.Payload}
+
+	if message.GatewayEui != "" || message.DataRate != "" || message.Frequency != 0 {
+		event.Radio = &iotf.RadioMetadata{
+			Gateway:        message.GatewayEui,
+			Rssi:           message.Rssi,
+			Snr:            message.Snr,
+			Frequency:      message.Frequency,
+			DataRate:       message.DataRate,
+			Port:           message.Port,
+			SequenceNumber: message.UniqueSequenceNo,
+		}
+	}
+
+	return event
+}
+
+// eventFromUplink decodes and names the IoTF event of an uplink. Uplinks that
+// cannot be decoded are published with their raw PDU.
+func (self *lrscConnection) eventFromUplink(message lrscMessage) iotf.Event {
+	event := convertLrscUpstreamMessageToEvent(message)
+
+	payload, err := self.devices.decodeUplink(message.DeviceGuid, message.Port, message.Payload)
+	if err != nil {
+		logger.Error("Could not decode uplink from %v: %v", message.DeviceGuid, err)
+		self.Report("DECODE_ERROR", fmt.Sprintf("%v: %v", message.DeviceGuid, err))
+
+		raw, _ := json.Marshal(map[string]string{"payload": message.Payload})
+		payload = string(raw)
+	}
+
+	event.Payload = payload
+	event.Name = self.devices.eventName(message.DeviceGuid, message.Port, payload)
+	return event
+}
+
 func (self *lrscConnection) readLine() (string, error) {
 	for {
-		data, _, err := self.reader.ReadLine()
+		message, err := self.conn.readMessage()
 		if err != nil {
 			return "", errors.New("failed to read message: " + err.Error())
 		}
 
-		if len(data) == 0 {
+		if len(message) == 0 {
 			continue
 		}
 
-		message := string(data)
 		logger.Debug("<<< " + message)
 		return message, nil
 	}
 }
 
-func validateHandshake(handshake string) bool {
-	return true
+func validateHandshake(handshake lrscHandshake, expectedEui string) error {
+	if handshake.Type != messageTypeHandshake {
+		return fmt.Errorf("Unexpected handshake reply: msgtag %v, expected %v", handshake.Type, messageTypeHandshake)
+	}
+
+	if handshake.Major != lrscProtocolMajor {
+		return fmt.Errorf("Unsupported LRSC protocol version %v.%v, expected %v.x", handshake.Major, handshake.Minor, lrscProtocolMajor)
+	}
+
+	if !euiMatcher.MatchString(handshake.Eui) {
+		return fmt.Errorf("Invalid EUI in handshake reply: %q", handshake.Eui)
+	}
+
+	if expectedEui != "" && !strings.EqualFold(handshake.Eui, expectedEui) {
+		return fmt.Errorf("Unexpected LRSC server EUI %v, expected %v", handshake.Eui, expectedEui)
+	}
+
+	return nil
+}
+
+// negotiateVersion settles on the older of the server's minor version and
+// the newest one we support
+func negotiateVersion(handshake lrscHandshake, supportedMinor int) string {
+	minor := handshake.Minor
+	if minor > supportedMinor {
+		minor = supportedMinor
+	}
+	return fmt.Sprintf("%v.%v", lrscProtocolMajor, minor)
 }
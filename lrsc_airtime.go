@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// the bytes a LoRaWAN frame adds to its payload: MHDR, FHDR, FPort and MIC
+	loraWANOverhead = 13
+
+	loraPreambleSymbols = 8
+	// coding rate 4/5
+	loraCodingRate = 1
+)
+
+var dataRateMatcher = regexp.MustCompile(`^SF(\d+)BW(\d+)$`)
+
+// loraDataRate is a LoRa modulation, written like SF7BW125
+type loraDataRate struct {
+	SpreadingFactor uint
+	// in kHz
+	Bandwidth uint
+}
+
+func parseDataRate(dataRate string) (loraDataRate, error) {
+	match := dataRateMatcher.FindStringSubmatch(dataRate)
+	if match == nil {
+		return loraDataRate{}, fmt.Errorf("Invalid data rate %q, expected e.g. SF7BW125", dataRate)
+	}
+
+	spreadingFactor, _ := strconv.ParseUint(match[1], 10, 8)
+	bandwidth, _ := strconv.ParseUint(match[2], 10, 16)
+	if spreadingFactor < 7 || spreadingFactor > 12 {
+		return loraDataRate{}, fmt.Errorf("Invalid spreading factor in %v", dataRate)
+	}
+	if bandwidth != 125 && bandwidth != 250 && bandwidth != 500 {
+		return loraDataRate{}, fmt.Errorf("Invalid bandwidth in %v", dataRate)
+	}
+	return loraDataRate{SpreadingFactor: uint(spreadingFactor), Bandwidth: uint(bandwidth)}, nil
+}
+
+func (self loraDataRate) String() string {
+	return fmt.Sprintf("SF%vBW%v", self.SpreadingFactor, self.Bandwidth)
+}
+
+// downlinkAirtime is the time on air of a downlink carrying payloadLength
+// bytes, after the formula of Semtech's SX1276 datasheet. Downlinks have an
+// explicit header and no payload CRC.
+func (self loraDataRate) downlinkAirtime(payloadLength int) time.Duration {
+	spreadingFactor := float64(self.SpreadingFactor)
+	symbol := math.Pow(2, spreadingFactor) / float64(self.Bandwidth*1000)
+
+	lowDataRateOptimize := 0.0
+	if symbol >= 0.016 {
+		lowDataRateOptimize = 1
+	}
+
+	bits := float64(8*(payloadLength+loraWANOverhead)) - 4*spreadingFactor + 28
+	payloadSymbols := 8 + math.Max(math.Ceil(bits/(4*(spreadingFactor-2*lowDataRateOptimize)))*(loraCodingRate+4), 0)
+	seconds := (loraPreambleSymbols + 4.25 + payloadSymbols) * symbol
+
+	return time.Duration(seconds*float64(time.Second) + 0.5)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Airtime", func() {
+	It("parses data rates", func() {
+		dataRate, err := parseDataRate("SF9BW125")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataRate).To(Equal(loraDataRate{SpreadingFactor: 9, Bandwidth: 125}))
+		Expect(dataRate.String()).To(Equal("SF9BW125"))
+	})
+
+	It("rejects invalid data rates", func() {
+		for _, dataRate := range []string{"", "FSK", "SF6BW125", "SF13BW125", "SF7BW300"} {
+			_, err := parseDataRate(dataRate)
+			Expect(err).To(HaveOccurred(), dataRate)
+		}
+	})
+
+	airtimes := []struct {
+		dataRate string
+		length   int
+		airtime  time.Duration
+	}{
+		{"SF7BW125", 0, 41216 * time.Microsecond},
+		{"SF7BW125", 10, 56576 * time.Microsecond},
+		{"SF9BW125", 10, 185344 * time.Microsecond},
+		{"SF12BW125", 0, 1155072 * time.Microsecond},
+		{"SF12BW125", 51, 2793472 * time.Microsecond},
+		{"SF7BW250", 10, 28288 * time.Microsecond},
+	}
+
+	for _, example := range airtimes {
+		example := example
+		It("calculates the airtime of "+example.dataRate+" downlinks", func() {
+			dataRate, _ := parseDataRate(example.dataRate)
+			Expect(dataRate.downlinkAirtime(example.length)).To(Equal(example.airtime))
+		})
+	}
+})
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/codec"
+	"strings"
+	"time"
+)
+
+// codecConfig names the codecs of device types and ports, see codec.Named.
+// "schema:<file>" and "script:<file>" name a codec.Schema or a codec.Script
+// read from a file; scripts run within the configured limits.
+type codecConfig struct {
+	Default     string            `json:"default"`
+	DeviceTypes map[string]string `json:"deviceTypes"`
+	Ports       map[uint]string   `json:"ports"`
+
+	ScriptTimeout  string `json:"scriptTimeout"`
+	ScriptSteps    uint64 `json:"scriptSteps"`
+	ScriptMemoryMB uint64 `json:"scriptMemoryMB"`
+}
+
+const (
+	schemaPrefix = "schema:"
+	scriptPrefix = "script:"
+)
+
+var defaultCodecs = codec.NewRegistry()
+
+func (self codecConfig) registry() (*codec.Registry, error) {
+	registry := codec.NewRegistry()
+	loaded := make(map[string]codec.Codec)
+
+	limits, err := self.scriptLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	resolve := func(name string) (codec.Codec, error) {
+		if existing, present := loaded[name]; present {
+			return existing, nil
+		}
+
+		var resolved codec.Codec
+		var err error
+		switch {
+		case strings.HasPrefix(name, schemaPrefix):
+			resolved, err = codec.LoadSchema(strings.TrimPrefix(name, schemaPrefix))
+		case strings.HasPrefix(name, scriptPrefix):
+			resolved, err = codec.LoadScript(strings.TrimPrefix(name, scriptPrefix), limits)
+		default:
+			resolved, err = codec.Named(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		loaded[name] = resolved
+		return resolved, nil
+	}
+
+	if self.Default != "" {
+		fallback, err := resolve(self.Default)
+		if err != nil {
+			return nil, err
+		}
+		registry.SetDefault(fallback)
+	}
+
+	for deviceType, name := range self.DeviceTypes {
+		deviceCodec, err := resolve(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid codec of device type %v: %v", deviceType, err)
+		}
+		registry.SetDeviceType(deviceType, deviceCodec)
+	}
+
+	for port, name := range self.Ports {
+		portCodec, err := resolve(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid codec of port %v: %v", port, err)
+		}
+		registry.SetPort(port, portCodec)
+	}
+
+	return registry, nil
+}
+
+func (self codecConfig) scriptLimits() (codec.ScriptLimits, error) {
+	limits := codec.ScriptLimits{Steps: self.ScriptSteps, Memory: self.ScriptMemoryMB << 20}
+	if self.ScriptTimeout != "" {
+		timeout, err := time.ParseDuration(self.ScriptTimeout)
+		if err != nil {
+			return limits, fmt.Errorf("Invalid scriptTimeout: %v", err)
+		}
+		limits.Timeout = timeout
+	}
+	return limits, nil
+}
+
+func (self *deviceConfig) codec(device string, port uint) codec.Codec {
+	if self == nil || self.codecs == nil {
+		return defaultCodecs.Codec("", port)
+	}
+	return self.codecs.Codec(self.deviceType(device), port)
+}
+
+// decodeUplink turns the hex encoded PDU of an uplink into JSON
+func (self *deviceConfig) decodeUplink(device string, port uint, pdu string) (string, error) {
+	data, err := hex.DecodeString(pdu)
+	if err != nil {
+		return "", fmt.Errorf("PDU is not hex encoded: %v", err)
+	}
+
+	decoded, err := self.codec(device, port).Decode(port, data)
+	return string(decoded), err
+}
+
+func (self *deviceConfig) encoder(device string, port uint) codec.Codec {
+	if self == nil || self.codecs == nil {
+		return defaultCodecs.Encoder("", port)
+	}
+	return self.codecs.Encoder(self.deviceType(device), port)
+}
+
+// encodeCommand turns the payload of a command into a hex encoded PDU
+func (self *deviceConfig) encodeCommand(device string, port uint, payload string) (string, error) {
+	encoded, err := self.encoder(device, port).Encode(port, []byte(payload))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(encoded), nil
+}
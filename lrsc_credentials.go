@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsCredentials holds the TLS configuration used for new LRSC connections.
+// It can be rebuilt while the bridge is running, so a rotated certificate is
+// picked up on the next reconnect.
+type tlsCredentials struct {
+	lock       sync.RWMutex
+	config     dialerConfig
+	sslContext *tls.Config
+	reporter   *reporter.StatusReporter
+}
+
+func loadTlsCredentials(config dialerConfig, reporter *reporter.StatusReporter) (*tlsCredentials, error) {
+	credentials := &tlsCredentials{config: config, reporter: reporter}
+	return credentials, credentials.reload()
+}
+
+func (self *tlsCredentials) context() *tls.Config {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.sslContext
+}
+
+func (self *tlsCredentials) reload() error {
+	context, err := createTlsContext(self.config)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(context.Certificates[0].Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	self.sslContext = context
+	self.lock.Unlock()
+
+	self.report("CERTIFICATE_EXPIRY", leaf.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// watch reloads the credentials whenever a signal arrives or, on each tick,
+// when one of the credential files has been modified. It returns once ticks
+// is closed.
+func (self *tlsCredentials) watch(signals <-chan os.Signal, ticks <-chan time.Time) {
+	modified := modificationTimes(self.files())
+
+	for {
+		select {
+		case signal := <-signals:
+			logger.Info("Received %v, reloading LRSC credentials", signal)
+		case _, open := <-ticks:
+			if !open {
+				return
+			}
+			current := modificationTimes(self.files())
+			if sameModificationTimes(modified, current) {
+				continue
+			}
+			modified = current
+			logger.Info("LRSC credentials changed on disk, reloading")
+		}
+
+		err := self.reload()
+		if err != nil {
+			logger.Error("Could not reload LRSC credentials: %v", err)
+			self.report("CERTIFICATE", err.Error())
+		} else {
+			self.report("CERTIFICATE", "OK")
+		}
+	}
+}
+
+func (self *tlsCredentials) files() []string {
+	if self.config.archive != "" {
+		return []string{self.config.archive, self.config.ca}
+	}
+	return []string{self.config.cert, self.config.key, self.config.ca}
+}
+
+func (self *tlsCredentials) report(key, value string) {
+	if self.reporter != nil {
+		(*self.reporter).Report(key, value)
+	}
+}
+
+func modificationTimes(files []string) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err == nil {
+			times[file] = info.ModTime()
+		}
+	}
+	return times
+}
+
+func sameModificationTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, time := range a {
+		if !time.Equal(b[file]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
+	"os"
+	"syscall"
+	"time"
+)
+
+var _ = Describe("LRSC credentials", func() {
+	var (
+		config         dialerConfig
+		statusReporter reporter.StatusReporter
+		credentials    *tlsCredentials
+		expiry         time.Time
+	)
+
+	BeforeEach(func() {
+		config = dialerConfig{host: "localhost"}
+		config.cert, config.key = writeTestCertificate()
+		expiry = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		writeTestCertificateFiles(config.cert, config.key, expiry)
+
+		statusReporter = reporter.New()
+		var err error
+		credentials, err = loadTlsCredentials(config, &statusReporter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	rotate := func(notAfter time.Time) {
+		writeTestCertificateFiles(config.cert, config.key, notAfter)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(config.cert, later, later)
+	}
+
+	It("reports when the certificate expires", func() {
+		Expect(statusReporter.Summary()).To(MatchJSON(`{"CERTIFICATE_EXPIRY":"2030-01-01T00:00:00Z"}`))
+	})
+
+	It("builds a new TLS configuration on reload", func() {
+		before := credentials.context()
+		rotate(expiry.AddDate(1, 0, 0))
+
+		Expect(credentials.reload()).To(Succeed())
+		Expect(credentials.context()).ToNot(BeIdenticalTo(before))
+		Expect(statusReporter.Summary()).To(ContainSubstring("2031-01-01T00:00:00Z"))
+	})
+
+	It("keeps the current configuration when the new files are broken", func() {
+		before := credentials.context()
+		os.Truncate(config.key, 0)
+
+		Expect(credentials.reload()).ToNot(Succeed())
+		Expect(credentials.context()).To(BeIdenticalTo(before))
+	})
+
+	Describe("watch", func() {
+		var (
+			signals chan os.Signal
+			ticks   chan time.Time
+		)
+
+		BeforeEach(func() {
+			signals = make(chan os.Signal)
+			ticks = make(chan time.Time)
+			go credentials.watch(signals, ticks)
+		})
+
+		AfterEach(func() {
+			close(ticks)
+		})
+
+		It("reloads on SIGHUP", func() {
+			writeTestCertificateFiles(config.cert, config.key, expiry.AddDate(2, 0, 0))
+			signals <- syscall.SIGHUP
+
+			Eventually(statusReporter.Summary).Should(ContainSubstring("2032-01-01T00:00:00Z"))
+		})
+
+		It("reloads when the files change", func() {
+			ticks <- time.Now()
+			rotate(expiry.AddDate(3, 0, 0))
+			ticks <- time.Now()
+
+			Eventually(statusReporter.Summary).Should(ContainSubstring("2033-01-01T00:00:00Z"))
+		})
+
+		It("does not reload when nothing changed", func() {
+			ticks <- time.Now()
+			ticks <- time.Now()
+
+			Expect(statusReporter.Summary()).ToNot(ContainSubstring(`"CERTIFICATE":`))
+		})
+	})
+})
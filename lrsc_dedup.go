@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDedupWindow = 10 * time.Minute
+
+// uplinkDeduplicator drops uplinks seen before within a time window: the
+// same frame heard by several gateways, or resent by LRSC after a reconnect
+type uplinkDeduplicator struct {
+	lock       sync.Mutex
+	window     time.Duration
+	seen       map[uplinkKey]struct{}
+	order      []seenUplink
+	duplicates map[string]uint64
+	now        func() time.Time
+}
+
+type uplinkKey struct {
+	device  string
+	seqno   uint64
+	payload [sha256.Size]byte
+}
+
+type seenUplink struct {
+	key  uplinkKey
+	time time.Time
+}
+
+func newUplinkDeduplicator(window time.Duration) *uplinkDeduplicator {
+	return &uplinkDeduplicator{
+		window:     window,
+		seen:       make(map[uplinkKey]struct{}),
+		duplicates: make(map[string]uint64),
+		now:        time.Now,
+	}
+}
+
+// duplicate records the uplink and tells whether it was already seen
+func (self *uplinkDeduplicator) duplicate(message lrscMessage) bool {
+	if self == nil || self.window <= 0 {
+		return false
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.now()
+	self.expire(now)
+
+	device := strings.ToUpper(message.DeviceGuid)
+	key := uplinkKey{device: device, seqno: message.UniqueSequenceNo, payload: sha256.Sum256([]byte(message.Payload))}
+	if _, seen := self.seen[key]; seen {
+		self.duplicates[device]++
+		return true
+	}
+
+	self.seen[key] = struct{}{}
+	self.order = append(self.order, seenUplink{key: key, time: now})
+	return false
+}
+
+func (self *uplinkDeduplicator) expire(now time.Time) {
+	expired := 0
+	for expired < len(self.order) && now.Sub(self.order[expired].time) >= self.window {
+		delete(self.seen, self.order[expired].key)
+		expired++
+	}
+	self.order = self.order[expired:]
+}
+
+// duplicatesByDevice returns the number of duplicates dropped per device
+func (self *uplinkDeduplicator) duplicatesByDevice() map[string]uint64 {
+	counts := make(map[string]uint64)
+	if self == nil {
+		return counts
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for device, count := range self.duplicates {
+		counts[device] = count
+	}
+	return counts
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Uplink deduplication", func() {
+	var (
+		dedup *uplinkDeduplicator
+		now   time.Time
+	)
+
+	uplink := lrscMessage{Type: messageTypeUpstream, DeviceGuid: "AA-00-00-00-00-00-00-01", Payload: "0102", UniqueSequenceNo: 7}
+
+	BeforeEach(func() {
+		now = time.Unix(1000, 0)
+		dedup = newUplinkDeduplicator(time.Minute)
+		dedup.now = func() time.Time { return now }
+	})
+
+	It("lets the first copy of an uplink through", func() {
+		Expect(dedup.duplicate(uplink)).To(BeFalse())
+	})
+
+	It("drops copies within the window", func() {
+		dedup.duplicate(uplink)
+		now = now.Add(59 * time.Second)
+
+		heardElsewhere := uplink
+		heardElsewhere.GatewayEui = "00-00-00-00-00-00-00-02"
+		Expect(dedup.duplicate(heardElsewhere)).To(BeTrue())
+	})
+
+	It("lets copies through after the window", func() {
+		dedup.duplicate(uplink)
+		now = now.Add(time.Minute)
+		Expect(dedup.duplicate(uplink)).To(BeFalse())
+	})
+
+	It("tells uplinks apart by device, sequence number and payload", func() {
+		dedup.duplicate(uplink)
+
+		otherDevice, otherSeqno, otherPayload := uplink, uplink, uplink
+		otherDevice.DeviceGuid = "00-00-00-00-00-00-00-09"
+		otherSeqno.UniqueSequenceNo = 8
+		otherPayload.Payload = "0103"
+
+		Expect(dedup.duplicate(otherDevice)).To(BeFalse())
+		Expect(dedup.duplicate(otherSeqno)).To(BeFalse())
+		Expect(dedup.duplicate(otherPayload)).To(BeFalse())
+	})
+
+	It("counts the duplicates of each device", func() {
+		dedup.duplicate(uplink)
+		dedup.duplicate(uplink)
+
+		lowerCase := uplink
+		lowerCase.DeviceGuid = "aa-00-00-00-00-00-00-01"
+		dedup.duplicate(lowerCase)
+
+		Expect(dedup.duplicatesByDevice()).To(Equal(map[string]uint64{"AA-00-00-00-00-00-00-01": 2}))
+	})
+
+	It("is disabled by a zero window", func() {
+		dedup = newUplinkDeduplicator(0)
+		dedup.duplicate(uplink)
+		Expect(dedup.duplicate(uplink)).To(BeFalse())
+		Expect((*uplinkDeduplicator)(nil).duplicate(uplink)).To(BeFalse())
+	})
+})
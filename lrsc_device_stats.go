@@ -0,0 +1,25 @@
+package main
+
+// deviceStats are the statistics of a device, served on /deviceStats
+type deviceStats struct {
+	Duplicates uint64 `json:"duplicates"`
+	linkStatus
+}
+
+func (self *lrscConnection) deviceStats() map[string]*deviceStats {
+	stats := make(map[string]*deviceStats)
+	device := func(eui string) *deviceStats {
+		if _, present := stats[eui]; !present {
+			stats[eui] = &deviceStats{}
+		}
+		return stats[eui]
+	}
+
+	for eui, count := range self.dedup.duplicatesByDevice() {
+		device(eui).Duplicates = count
+	}
+	for eui, status := range self.frames.statusByDevice() {
+		device(eui).linkStatus = status
+	}
+	return stats
+}
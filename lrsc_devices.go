@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/codec"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	minApplicationPort = 1
+	maxApplicationPort = 223
+)
+
+// deviceConfig describes the LoRa devices behind the bridge: the type of
+// each device, by EUI, the ports their commands are sent on, the IoTF
+// events their uplinks are published as, the codecs of their payloads,
+// their LoRaWAN classes and which of them fragment large payloads
+type deviceConfig struct {
+	Devices       map[string]string   `json:"devices"`
+	CommandPorts  commandPorts        `json:"commandPorts"`
+	Events        []eventRoute        `json:"events"`
+	Codecs        codecConfig         `json:"codecs"`
+	Classes       classConfig         `json:"classes"`
+	Fragmentation fragmentationConfig `json:"fragmentation"`
+
+	codecs *codec.Registry
+}
+
+// commandPorts maps IoTF command names to LoRa ports. Device types can
+// override both the default port and the ports of single commands.
+type commandPorts struct {
+	portMapping
+	DeviceTypes map[string]portMapping `json:"deviceTypes"`
+}
+
+type portMapping struct {
+	Default  uint            `json:"default"`
+	Commands map[string]uint `json:"commands"`
+}
+
+// eventRoute names the IoTF event of the uplinks it matches. Every criterion
+// that is set must match: the port, the device type and a field of the JSON
+// payload, optionally with a given value.
+type eventRoute struct {
+	Port       *uint  `json:"port"`
+	DeviceType string `json:"deviceType"`
+	Field      string `json:"field"`
+	Value      string `json:"value"`
+	Name       string `json:"name"`
+}
+
+// loadDeviceConfig reads the JSON device configuration; without a path every
+// command goes to lrscDevicePort and every event is named after its port
+func loadDeviceConfig(path string) (*deviceConfig, error) {
+	config := &deviceConfig{}
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read device configuration: %v", err)
+	}
+
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse device configuration %v: %v", path, err)
+	}
+
+	devices := make(map[string]string)
+	for eui, deviceType := range config.Devices {
+		devices[strings.ToUpper(eui)] = deviceType
+	}
+	config.Devices = devices
+
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	config.codecs, err = config.Codecs.registry()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (self *deviceConfig) validate() error {
+	err := self.CommandPorts.portMapping.validate("")
+	if err != nil {
+		return err
+	}
+
+	for deviceType, mapping := range self.CommandPorts.DeviceTypes {
+		err = mapping.validate(fmt.Sprintf(" of device type %v", deviceType))
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, route := range self.Events {
+		if route.Name == "" {
+			return fmt.Errorf("Event route %v has no name", i+1)
+		}
+		if route.Value != "" && route.Field == "" {
+			return fmt.Errorf("Event route %v has a value but no field", i+1)
+		}
+	}
+	err = self.Classes.validate()
+	if err != nil {
+		return err
+	}
+	return self.Fragmentation.validate()
+}
+
+func (self portMapping) validate(scope string) error {
+	if self.Default != 0 && !validApplicationPort(self.Default) {
+		return fmt.Errorf("Invalid default command port%v: %v", scope, self.Default)
+	}
+
+	for command, port := range self.Commands {
+		if !validApplicationPort(port) {
+			return fmt.Errorf("Invalid port for command %v%v: %v", command, scope, port)
+		}
+	}
+	return nil
+}
+
+// deviceType returns the configured type of a device, or "" if it has none
+func (self *deviceConfig) deviceType(device string) string {
+	if self == nil {
+		return ""
+	}
+	return self.Devices[strings.ToUpper(device)]
+}
+
+// commandPort picks the port for a command, preferring the settings of the
+// device's type over the global ones, and the command over the default
+func (self *deviceConfig) commandPort(device, command string) uint {
+	if self == nil {
+		return lrscDevicePort
+	}
+
+	global := self.CommandPorts.portMapping
+	override, hasOverride := self.CommandPorts.DeviceTypes[self.deviceType(device)]
+
+	if port, present := override.Commands[command]; hasOverride && present {
+		return port
+	}
+	if hasOverride && override.Default != 0 {
+		return override.Default
+	}
+	if port, present := global.Commands[command]; present {
+		return port
+	}
+	if global.Default != 0 {
+		return global.Default
+	}
+	return lrscDevicePort
+}
+
+// eventName picks the IoTF event of an uplink from the first matching route,
+// falling back to the port number
+func (self *deviceConfig) eventName(device string, port uint, payload string) string {
+	if self != nil && len(self.Events) > 0 {
+		deviceType := self.deviceType(device)
+		fields := payloadFields(payload)
+
+		for _, route := range self.Events {
+			if route.matches(deviceType, port, fields) {
+				return route.Name
+			}
+		}
+	}
+	return strconv.FormatUint(uint64(port), 10)
+}
+
+func (self eventRoute) matches(deviceType string, port uint, fields map[string]interface{}) bool {
+	if self.Port != nil && *self.Port != port {
+		return false
+	}
+	if self.DeviceType != "" && self.DeviceType != deviceType {
+		return false
+	}
+	if self.Field != "" {
+		value, present := fields[self.Field]
+		if !present || (self.Value != "" && fmt.Sprint(value) != self.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// payloadFields returns the top level fields of a JSON object payload, or
+// nothing if the payload is not one
+func payloadFields(payload string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	json.Unmarshal([]byte(payload), &fields)
+	return fields
+}
+
+func validApplicationPort(port uint) bool {
+	return port >= minApplicationPort && port <= maxApplicationPort
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("deviceConfig", func() {
+	var devices *deviceConfig
+
+	BeforeEach(func() {
+		devices = &deviceConfig{
+			Devices: map[string]string{"00-00-00-00-00-00-00-01": "thermostat", "00-00-00-00-00-00-00-02": "valve"},
+			CommandPorts: commandPorts{
+				portMapping: portMapping{Default: 20, Commands: map[string]uint{"config": 3, "firmware": 200}},
+				DeviceTypes: map[string]portMapping{
+					"thermostat": {Commands: map[string]uint{"config": 5}},
+					"valve":      {Default: 7},
+				},
+			},
+		}
+	})
+
+	Describe("commandPort", func() {
+		It("prefers a command port of the device type", func() {
+			Expect(devices.commandPort("00-00-00-00-00-00-00-01", "config")).To(BeEquivalentTo(5))
+		})
+
+		It("falls back to the global command port", func() {
+			Expect(devices.commandPort("00-00-00-00-00-00-00-01", "firmware")).To(BeEquivalentTo(200))
+		})
+
+		It("prefers the default port of the device type over global command ports", func() {
+			Expect(devices.commandPort("00-00-00-00-00-00-00-02", "config")).To(BeEquivalentTo(7))
+		})
+
+		It("uses the global default for unknown commands and devices", func() {
+			Expect(devices.commandPort("00-00-00-00-00-00-00-01", "reboot")).To(BeEquivalentTo(20))
+			Expect(devices.commandPort("00-00-00-00-00-00-00-09", "reboot")).To(BeEquivalentTo(20))
+		})
+
+		It("matches device EUIs case-insensitively", func() {
+			devices, _ = writeAndLoadDeviceConfig(`{"devices": {"aa-00-00-00-00-00-00-01": "valve"}, "commandPorts": {"deviceTypes": {"valve": {"default": 7}}}}`)
+			Expect(devices.commandPort("AA-00-00-00-00-00-00-01", "open")).To(BeEquivalentTo(7))
+		})
+
+		It("uses lrscDevicePort when nothing is configured", func() {
+			Expect((&deviceConfig{}).commandPort("00-00-00-00-00-00-00-01", "config")).To(Equal(lrscDevicePort))
+			Expect((*deviceConfig)(nil).commandPort("00-00-00-00-00-00-00-01", "config")).To(Equal(lrscDevicePort))
+		})
+	})
+
+	Describe("eventName", func() {
+		port := func(port uint) *uint { return &port }
+
+		BeforeEach(func() {
+			devices.Events = []eventRoute{
+				{Field: "alarm", Value: "true", Name: "alarm"},
+				{DeviceType: "thermostat", Port: port(2), Name: "temperature"},
+				{Port: port(2), Name: "telemetry"},
+				{DeviceType: "valve", Name: "valve"},
+			}
+		})
+
+		It("names events after their port by default", func() {
+			Expect((&deviceConfig{}).eventName("00-00-00-00-00-00-00-01", 5, "")).To(Equal("5"))
+			Expect((*deviceConfig)(nil).eventName("00-00-00-00-00-00-00-01", 5, "")).To(Equal("5"))
+			Expect(devices.eventName("00-00-00-00-00-00-00-01", 5, "")).To(Equal("5"))
+		})
+
+		It("routes by port and device type", func() {
+			Expect(devices.eventName("00-00-00-00-00-00-00-01", 2, "")).To(Equal("temperature"))
+			Expect(devices.eventName("00-00-00-00-00-00-00-09", 2, "")).To(Equal("telemetry"))
+			Expect(devices.eventName("00-00-00-00-00-00-00-02", 9, "")).To(Equal("valve"))
+		})
+
+		It("routes by payload fields", func() {
+			Expect(devices.eventName("00-00-00-00-00-00-00-01", 2, `{"alarm":true}`)).To(Equal("alarm"))
+			Expect(devices.eventName("00-00-00-00-00-00-00-01", 2, `{"alarm":false}`)).To(Equal("temperature"))
+		})
+
+		It("ignores payloads that are not JSON objects", func() {
+			Expect(devices.eventName("00-00-00-00-00-00-00-01", 2, "0102")).To(Equal("temperature"))
+		})
+	})
+
+	Describe("loadDeviceConfig", func() {
+		It("returns an empty configuration without a path", func() {
+			devices, err := loadDeviceConfig("")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(devices.deviceType("00-00-00-00-00-00-00-01")).To(BeEmpty())
+		})
+
+		It("reads device types and command ports", func() {
+			devices, err := writeAndLoadDeviceConfig(`{
+				"devices": {"00-00-00-00-00-00-00-01": "thermostat"},
+				"commandPorts": {"default": 20, "commands": {"config": 3}, "deviceTypes": {"thermostat": {"commands": {"config": 5}}}}
+			}`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(devices.deviceType("00-00-00-00-00-00-00-01")).To(Equal("thermostat"))
+			Expect(devices.commandPort("00-00-00-00-00-00-00-01", "config")).To(BeEquivalentTo(5))
+			Expect(devices.commandPort("00-00-00-00-00-00-00-02", "config")).To(BeEquivalentTo(3))
+		})
+
+		It("rejects invalid JSON", func() {
+			_, err := writeAndLoadDeviceConfig(`{"devices": `)
+			Expect(err).To(MatchError(ContainSubstring("Could not parse device configuration")))
+		})
+
+		It("rejects ports outside the application range", func() {
+			_, err := writeAndLoadDeviceConfig(`{"commandPorts": {"commands": {"config": 0}}}`)
+			Expect(err).To(MatchError("Invalid port for command config: 0"))
+
+			_, err = writeAndLoadDeviceConfig(`{"commandPorts": {"deviceTypes": {"valve": {"default": 224}}}}`)
+			Expect(err).To(MatchError("Invalid default command port of device type valve: 224"))
+		})
+
+		It("reads event routes", func() {
+			devices, err := writeAndLoadDeviceConfig(`{"events": [{"port": 0, "name": "mac"}, {"field": "kind", "value": "boot", "name": "boot"}]}`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(devices.eventName("00-00-00-00-00-00-00-01", 0, "")).To(Equal("mac"))
+			Expect(devices.eventName("00-00-00-00-00-00-00-01", 1, `{"kind":"boot"}`)).To(Equal("boot"))
+		})
+
+		It("rejects invalid event routes", func() {
+			_, err := writeAndLoadDeviceConfig(`{"events": [{"port": 1}]}`)
+			Expect(err).To(MatchError("Event route 1 has no name"))
+
+			_, err = writeAndLoadDeviceConfig(`{"events": [{"port": 1, "name": "a"}, {"value": "x", "name": "b"}]}`)
+			Expect(err).To(MatchError("Event route 2 has a value but no field"))
+		})
+
+		It("loads schemas named as codecs", func() {
+			dir, _ := ioutil.TempDir("", "lrsc-schemas")
+			defer os.RemoveAll(dir)
+			schema := filepath.Join(dir, "thermostat.json")
+			ioutil.WriteFile(schema, []byte(`{"fields": [{"name": "temperature", "offset": 0, "length": 2, "scale": 0.1}]}`), 0600)
+
+			devices, err := writeAndLoadDeviceConfig(`{"devices": {"00-00-00-00-00-00-00-01": "thermostat"}, "codecs": {"deviceTypes": {"thermostat": "schema:` + schema + `"}}}`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(devices.decodeUplink("00-00-00-00-00-00-00-01", 1, "0110")).To(MatchJSON(`{"temperature": 27.2}`))
+			Expect(devices.encodeCommand("00-00-00-00-00-00-00-01", 1, "01ab")).To(Equal("01ab"))
+		})
+
+		It("rejects invalid schemas and unknown codecs", func() {
+			_, err := writeAndLoadDeviceConfig(`{"codecs": {"ports": {"1": "schema:/does/not/exist.json"}}}`)
+			Expect(err).To(MatchError(ContainSubstring("Could not read schema")))
+
+			_, err = writeAndLoadDeviceConfig(`{"codecs": {"deviceTypes": {"valve": "morse"}}}`)
+			Expect(err).To(MatchError(ContainSubstring("Invalid codec of device type valve: Unknown codec morse")))
+		})
+
+		It("reports a missing file", func() {
+			_, err := loadDeviceConfig("/does/not/exist.json")
+			Expect(err).To(MatchError(ContainSubstring("Could not read device configuration")))
+		})
+	})
+})
+
+func writeAndLoadDeviceConfig(content string) (*deviceConfig, error) {
+	dir, _ := ioutil.TempDir("", "lrsc-devices")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "devices.json")
+	ioutil.WriteFile(file, []byte(content), 0600)
+	return loadDeviceConfig(file)
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	classA = "A"
+	classC = "C"
+
+	// Class A commands are either held until the device's next uplink or
+	// handed to LRSC, which holds them itself
+	releaseOnUplink = "uplink"
+	releaseToLrsc   = "lrsc"
+
+	// how long idempotency keys of released commands are remembered
+	idempotencyWindow = 24 * time.Hour
+
+	// how often queued commands are checked for expiry and retried
+	downlinkCheckInterval = 10 * time.Second
+)
+
+// classConfig sets the LoRaWAN class of device types, Class A by default,
+// and when Class A commands are released
+type classConfig struct {
+	DeviceTypes map[string]string `json:"deviceTypes"`
+	ClassA      string            `json:"classA"`
+}
+
+func (self classConfig) validate() error {
+	for deviceType, class := range self.DeviceTypes {
+		if class != classA && class != classC {
+			return fmt.Errorf("Invalid class of device type %v: %v, expected A or C", deviceType, class)
+		}
+	}
+	if self.ClassA != "" && self.ClassA != releaseOnUplink && self.ClassA != releaseToLrsc {
+		return fmt.Errorf("Invalid Class A release: %v, expected %v or %v", self.ClassA, releaseOnUplink, releaseToLrsc)
+	}
+	return nil
+}
+
+// waitsForUplink tells whether the commands of a device are held until it
+// sends an uplink
+func (self *deviceConfig) waitsForUplink(device string) bool {
+	if self == nil {
+		return false
+	}
+	if self.Classes.DeviceTypes[self.deviceType(device)] == classC {
+		return false
+	}
+	return self.Classes.ClassA == releaseOnUplink
+}
+
+// downlinkQueue keeps the commands of every device in order until they are
+// sent to LRSC, high priority commands first. It remembers the idempotency
+// keys of released commands for idempotencyWindow. With a path, the queue is
+// stored in a file after every change so that it survives restarts.
+type downlinkQueue struct {
+	lock  sync.Mutex
+	path  string
+	state downlinkState
+	now   func() time.Time
+}
+
+type downlinkState struct {
+	Devices map[string][]queuedDownlink `json:"devices"`
+	// the release times of idempotency keys, by device and key
+	Released map[string]time.Time `json:"released"`
+}
+
+type queuedDownlink struct {
+	Command bridge.Command `json:"command"`
+	Queued  time.Time      `json:"queued"`
+	Delayed bool           `json:"delayed,omitempty"`
+
+	// Fragmented holds the frames of a command sent in fragments
+	Fragmented *fragmentedDownlink `json:"fragmented,omitempty"`
+}
+
+func openDownlinkQueue(path string) (*downlinkQueue, error) {
+	queue := &downlinkQueue{path: path, now: time.Now}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Could not read downlink queue: %v", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &queue.state); err != nil {
+				return nil, fmt.Errorf("Could not parse downlink queue %v: %v", path, err)
+			}
+		}
+	}
+
+	if queue.state.Devices == nil {
+		queue.state.Devices = make(map[string][]queuedDownlink)
+	}
+	if queue.state.Released == nil {
+		queue.state.Released = make(map[string]time.Time)
+	}
+	return queue, nil
+}
+
+func idempotencyKey(device, key string) string {
+	return device + " " + key
+}
+
+// push queues a command unless it repeats the idempotency key of a command
+// queued or released before
+func (self *downlinkQueue) push(command bridge.Command) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	device := strings.ToUpper(command.Device)
+	queued := self.state.Devices[device]
+
+	if command.IdempotencyKey != "" {
+		for key, released := range self.state.Released {
+			if self.now().Sub(released) >= idempotencyWindow {
+				delete(self.state.Released, key)
+			}
+		}
+		if _, released := self.state.Released[idempotencyKey(device, command.IdempotencyKey)]; released {
+			return false
+		}
+		for _, other := range queued {
+			if other.Command.IdempotencyKey == command.IdempotencyKey {
+				return false
+			}
+		}
+	}
+
+	position := len(queued)
+	if command.HighPriority {
+		position = 0
+		for position < len(queued) && queued[position].Command.HighPriority {
+			position++
+		}
+	}
+
+	downlink := queuedDownlink{Command: command, Queued: self.now()}
+	queued = append(queued, queuedDownlink{})
+	copy(queued[position+1:], queued[position:])
+	queued[position] = downlink
+	self.state.Devices[device] = queued
+
+	self.persist()
+	return true
+}
+
+// head returns the next command of a device
+func (self *downlinkQueue) head(device string) (queuedDownlink, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	queued := self.state.Devices[strings.ToUpper(device)]
+	if len(queued) == 0 {
+		return queuedDownlink{}, false
+	}
+	return queued[0], true
+}
+
+// delay marks a queued command as delayed and tells whether it was not before
+func (self *downlinkQueue) delay(command bridge.Command) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	queued, index := self.find(command)
+	if index < 0 || queued[index].Delayed {
+		return false
+	}
+	queued[index].Delayed = true
+	self.persist()
+	return true
+}
+
+// fragment has a queued command sent in fragments
+func (self *downlinkQueue) fragment(command bridge.Command, fragmented *fragmentedDownlink) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	queued, index := self.find(command)
+	if index < 0 {
+		return
+	}
+	queued[index].Fragmented = fragmented
+	self.persist()
+}
+
+// advance counts a frame of a queued command as sent and tells whether it
+// was the last one; a command that is no longer queued has none left
+func (self *downlinkQueue) advance(command bridge.Command) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	queued, index := self.find(command)
+	if index < 0 {
+		return false
+	}
+	if queued[index].Fragmented == nil {
+		return true
+	}
+	fragmented := queued[index].Fragmented
+	fragmented.Sent++
+	self.persist()
+	return fragmented.Sent >= len(fragmented.Frames)
+}
+
+// pop removes a command once it was released. Commands cancelled or
+// expired while they were being sent are gone already.
+func (self *downlinkQueue) pop(command bridge.Command) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	_, index := self.find(command)
+	if index < 0 {
+		return
+	}
+
+	device := strings.ToUpper(command.Device)
+	if key := command.IdempotencyKey; key != "" {
+		self.state.Released[idempotencyKey(device, key)] = self.now()
+	}
+	self.remove(device, index)
+	self.persist()
+}
+
+// find returns the queue of a command's device and the command's index in
+// it, -1 when it is not queued
+func (self *downlinkQueue) find(command bridge.Command) ([]queuedDownlink, int) {
+	queued := self.state.Devices[strings.ToUpper(command.Device)]
+	for i, downlink := range queued {
+		if downlink.Command.CorrelationId == command.CorrelationId {
+			return queued, i
+		}
+	}
+	return queued, -1
+}
+
+// cancel removes a queued command by its correlation id
+func (self *downlinkQueue) cancel(correlationId string) (bridge.Command, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for device, queued := range self.state.Devices {
+		for i, downlink := range queued {
+			if downlink.Command.CorrelationId == correlationId {
+				self.remove(device, i)
+				self.persist()
+				return downlink.Command, true
+			}
+		}
+	}
+	return bridge.Command{}, false
+}
+
+// expire removes and returns the commands that expired
+func (self *downlinkQueue) expire() []bridge.Command {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var expired []bridge.Command
+	now := self.now()
+	for device, queued := range self.state.Devices {
+		for i := len(queued) - 1; i >= 0; i-- {
+			command := queued[i].Command
+			if !command.Expires.IsZero() && !now.Before(command.Expires) {
+				expired = append(expired, command)
+				self.remove(device, i)
+			}
+		}
+	}
+
+	if len(expired) > 0 {
+		self.persist()
+	}
+	return expired
+}
+
+func (self *downlinkQueue) remove(device string, index int) {
+	queued := self.state.Devices[device]
+	queued = append(queued[:index], queued[index+1:]...)
+	if len(queued) == 0 {
+		delete(self.state.Devices, device)
+	} else {
+		self.state.Devices[device] = queued
+	}
+}
+
+// queuedDevices returns the devices with queued commands, sorted
+func (self *downlinkQueue) queuedDevices() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	devices := make([]string, 0, len(self.state.Devices))
+	for device := range self.state.Devices {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// list returns the queued commands by device
+func (self *downlinkQueue) list() map[string][]queuedDownlink {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	devices := make(map[string][]queuedDownlink)
+	for device, queued := range self.state.Devices {
+		devices[device] = append([]queuedDownlink{}, queued...)
+	}
+	return devices
+}
+
+func (self *downlinkQueue) depth() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	depth := 0
+	for _, queued := range self.state.Devices {
+		depth += len(queued)
+	}
+	return depth
+}
+
+func (self *downlinkQueue) persist() {
+	if self.path == "" {
+		return
+	}
+
+	data, _ := json.Marshal(self.state)
+	temporary := self.path + ".tmp"
+	err := ioutil.WriteFile(temporary, data, 0600)
+	if err == nil {
+		err = os.Rename(temporary, self.path)
+	}
+	if err != nil {
+		logger.Error("Could not store downlink queue: %v", err)
+	}
+}
+
+// queueCommand queues a command behind the others of its device, reports it
+// as queued unless it is a duplicate, and sends it right away unless the
+// device is only listening after an uplink
+func (self *lrscConnection) queueCommand(command bridge.Command) {
+	if !self.downlinks.push(command) {
+		logger.Info("Ignoring command %v for %v, idempotency key %v was seen before", command.CorrelationId, command.Device, command.IdempotencyKey)
+		self.results <- bridge.CommandResult{Command: command, Status: bridge.CommandDuplicate, Reason: "idempotency key " + command.IdempotencyKey + " was seen before"}
+		return
+	}
+	self.results <- bridge.CommandResult{Command: command, Status: bridge.CommandQueued}
+	self.reportDownlinks()
+
+	if !self.devices.waitsForUplink(command.Device) {
+		self.releaseDownlinks(command.Device, 0)
+	}
+}
+
+// releaseAfterUplink sends the next command of a device that waits for an
+// uplink, in the receive window the uplink opened
+func (self *lrscConnection) releaseAfterUplink(device string) {
+	if self.downlinks != nil && self.devices.waitsForUplink(device) {
+		self.releaseDownlinks(device, 1)
+	}
+}
+
+// releaseQueuedDownlinks sends the commands held while LRSC was unreachable
+func (self *lrscConnection) releaseQueuedDownlinks() {
+	if self.downlinks == nil {
+		return
+	}
+	for _, device := range self.downlinks.queuedDevices() {
+		if !self.devices.waitsForUplink(device) {
+			self.releaseDownlinks(device, 0)
+		}
+	}
+}
+
+// releaseDownlinks sends up to limit downlinks of a device in order, all of
+// them for no limit; every frame of a fragmented command counts. Commands
+// stay queued while LRSC is unreachable or the duty cycle does not allow
+// them yet; commands that cannot be encoded or never fit into the duty
+// cycle fail, and oversize ones are fragmented if their device supports it.
+func (self *lrscConnection) releaseDownlinks(device string, limit int) {
+	self.releasing.Lock()
+	defer self.releasing.Unlock()
+	defer self.reportDownlinks()
+
+	// acknowledgements that arrive before a command is reported as sent
+	// wait for it
+	self.pending.hold()
+	defer self.pending.release()
+
+	self.expireDownlinks()
+
+	for sent := 0; limit == 0 || sent < limit; {
+		queued, present := self.downlinks.head(device)
+		if !present || atomic.LoadInt32(&self.connected) == 0 {
+			return
+		}
+
+		command := queued.Command
+		var err error
+		if queued.Fragmented != nil {
+			err = self.sendFragment(command, queued.Fragmented)
+		} else {
+			err = self.sendCommand(command)
+		}
+		if _, tooLarge := err.(payloadSizeError); tooLarge && queued.Fragmented == nil && self.fragmentsCommands(device) {
+			fragmentErr := self.fragmentCommand(command)
+			if fragmentErr == nil {
+				continue
+			}
+			if fragmentErr == errFragmentSessionsBusy {
+				logger.Info("Delaying commands for %v: %v", device, fragmentErr)
+				if self.downlinks.delay(command) {
+					self.results <- bridge.CommandResult{Command: command, Status: bridge.CommandDelayed, Reason: fragmentErr.Error()}
+				}
+				return
+			}
+			if rejected(fragmentErr) {
+				err = fragmentErr
+			}
+		}
+		if dutyCycle, limited := err.(dutyCycleError); limited && dutyCycle.Wait > 0 {
+			logger.Info("Delaying commands for %v: %v", device, err)
+			if self.downlinks.delay(command) {
+				self.results <- bridge.CommandResult{Command: command, Status: bridge.CommandDelayed, Reason: err.Error()}
+			}
+			return
+		}
+		if rejected(err) {
+			logger.Error("Could not send command to %v: %v", command.Device, err)
+			self.failCommand(command, err)
+			self.downlinks.pop(command)
+			self.fragments.dropDownlink(command)
+			continue
+		}
+		if err != nil {
+			logger.Warning("Keeping commands for %v queued: %v", device, err)
+			return
+		}
+
+		sent++
+		if queued.Fragmented != nil {
+			last := self.downlinks.advance(command)
+			self.fragments.downlinkSent(command, queued.Fragmented.Session, last)
+			if !last {
+				continue
+			}
+		}
+
+		self.downlinks.pop(command)
+		self.results <- bridge.CommandResult{Command: command, Status: bridge.CommandSent}
+	}
+}
+
+// expireDownlinks drops the commands that expired before they were sent
+func (self *lrscConnection) expireDownlinks() {
+	if self.downlinks == nil {
+		return
+	}
+
+	expired := self.downlinks.expire()
+	for _, command := range expired {
+		logger.Info("Command %v for %v expired", command.CorrelationId, command.Device)
+		self.fragments.dropDownlink(command)
+		self.results <- bridge.CommandResult{Command: command, Status: bridge.CommandExpired, Reason: "expired before it was sent"}
+	}
+	if len(expired) > 0 {
+		self.reportDownlinks()
+	}
+}
+
+// cancelCommand removes a command from the queue before it is sent
+func (self *lrscConnection) cancelCommand(correlationId string) bool {
+	command, queued := self.downlinks.cancel(correlationId)
+	if !queued {
+		return false
+	}
+
+	logger.Info("Command %v for %v was cancelled", correlationId, command.Device)
+	self.fragments.dropDownlink(command)
+	self.results <- bridge.CommandResult{Command: command, Status: bridge.CommandCancelled}
+	self.reportDownlinks()
+	return true
+}
+
+// rejected tells whether sending a command failed for good
+func rejected(err error) bool {
+	switch err.(type) {
+	case commandEncodingError, dutyCycleError, payloadSizeError:
+		return true
+	}
+	return false
+}
+
+func (self *lrscConnection) failCommand(command bridge.Command, err error) {
+	if self.deadLetters != nil {
+		payload, _ := json.Marshal(command)
+		self.deadLetters.Add(bridge.StageDownlink, string(payload), err)
+	}
+
+	result := bridge.CommandResult{Command: command, Status: bridge.CommandFailed, Reason: err.Error()}
+	if size, tooLarge := err.(payloadSizeError); tooLarge {
+		result.Status = bridge.CommandRejected
+		result.Rejection = size.rejection()
+	}
+	self.results <- result
+}
+
+func (self *lrscConnection) reportDownlinks() {
+	self.Report("DOWNLINK_QUEUE", strconv.Itoa(self.downlinks.depth()))
+}
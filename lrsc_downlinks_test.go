@@ -0,0 +1,400 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/deadletter"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Downlink queue", func() {
+	It("keeps the commands of every device in order", func() {
+		queue, _ := openDownlinkQueue("")
+		queue.push(bridge.Command{Device: "aa", Payload: "01", CorrelationId: "one"})
+		queue.push(bridge.Command{Device: "bb", Payload: "02", CorrelationId: "two"})
+		queue.push(bridge.Command{Device: "AA", Payload: "03", CorrelationId: "three"})
+
+		Expect(queue.queuedDevices()).To(Equal([]string{"AA", "BB"}))
+		Expect(queue.depth()).To(Equal(3))
+
+		head, _ := queue.head("aa")
+		Expect(head.Command.Payload).To(Equal("01"))
+		queue.pop(head.Command)
+		head, _ = queue.head("aa")
+		Expect(head.Command.Payload).To(Equal("03"))
+		queue.pop(head.Command)
+
+		_, present := queue.head("aa")
+		Expect(present).To(BeFalse())
+		Expect(queue.list()).To(HaveKey("BB"))
+		Expect(queue.list()).NotTo(HaveKey("AA"))
+	})
+
+	It("pops only the command it is given", func() {
+		queue, _ := openDownlinkQueue("")
+		queue.push(bridge.Command{Device: "aa", Payload: "01", CorrelationId: "one"})
+		queue.push(bridge.Command{Device: "aa", Payload: "02", CorrelationId: "two"})
+
+		head, _ := queue.head("aa")
+		queue.cancel("one")
+		queue.pop(head.Command)
+
+		head, _ = queue.head("aa")
+		Expect(head.Command.CorrelationId).To(Equal("two"))
+	})
+
+	It("puts high priority commands before the others", func() {
+		queue, _ := openDownlinkQueue("")
+		queue.push(bridge.Command{Device: "aa", Payload: "01"})
+		queue.push(bridge.Command{Device: "aa", Payload: "02", HighPriority: true})
+		queue.push(bridge.Command{Device: "aa", Payload: "03", HighPriority: true})
+		queue.push(bridge.Command{Device: "aa", Payload: "04"})
+
+		var order []string
+		for _, downlink := range queue.list()["AA"] {
+			order = append(order, downlink.Command.Payload)
+		}
+		Expect(order).To(Equal([]string{"02", "03", "01", "04"}))
+	})
+
+	Describe("idempotency keys", func() {
+		var (
+			queue *downlinkQueue
+			now   time.Time
+		)
+
+		BeforeEach(func() {
+			now = time.Now()
+			queue, _ = openDownlinkQueue("")
+			queue.now = func() time.Time { return now }
+		})
+
+		It("ignores commands repeating the key of a queued one", func() {
+			Expect(queue.push(bridge.Command{Device: "aa", IdempotencyKey: "k"})).To(BeTrue())
+			Expect(queue.push(bridge.Command{Device: "AA", IdempotencyKey: "k"})).To(BeFalse())
+			Expect(queue.push(bridge.Command{Device: "bb", IdempotencyKey: "k"})).To(BeTrue())
+			Expect(queue.push(bridge.Command{Device: "aa"})).To(BeTrue())
+		})
+
+		It("ignores commands repeating the key of a recently released one", func() {
+			command := bridge.Command{Device: "aa", IdempotencyKey: "k"}
+			queue.push(command)
+			queue.pop(command)
+			Expect(queue.push(bridge.Command{Device: "aa", IdempotencyKey: "k"})).To(BeFalse())
+
+			now = now.Add(idempotencyWindow)
+			Expect(queue.push(bridge.Command{Device: "aa", IdempotencyKey: "k"})).To(BeTrue())
+		})
+
+		It("accepts the key of a cancelled command again", func() {
+			queue.push(bridge.Command{Device: "aa", IdempotencyKey: "k", CorrelationId: "c"})
+			queue.cancel("c")
+			Expect(queue.push(bridge.Command{Device: "aa", IdempotencyKey: "k"})).To(BeTrue())
+		})
+	})
+
+	It("removes expired commands", func() {
+		queue, _ := openDownlinkQueue("")
+		now := time.Now()
+		queue.push(bridge.Command{Device: "aa", Payload: "01", Expires: now.Add(-time.Second)})
+		queue.push(bridge.Command{Device: "aa", Payload: "02", Expires: now.Add(time.Hour)})
+		queue.push(bridge.Command{Device: "aa", Payload: "03"})
+
+		expired := queue.expire()
+		Expect(expired).To(HaveLen(1))
+		Expect(expired[0].Payload).To(Equal("01"))
+		Expect(queue.depth()).To(Equal(2))
+	})
+
+	It("survives restarts", func() {
+		dir, _ := ioutil.TempDir("", "downlinks")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "downlinks.json")
+
+		queue, err := openDownlinkQueue(path)
+		Expect(err).NotTo(HaveOccurred())
+		queue.push(bridge.Command{Device: "aa", Payload: "01", CorrelationId: "one", IdempotencyKey: "k"})
+		queue.push(bridge.Command{Device: "aa", Payload: "02", CorrelationId: "two"})
+		queue.pop(bridge.Command{Device: "aa", CorrelationId: "one", IdempotencyKey: "k"})
+
+		reopened, err := openDownlinkQueue(path)
+		Expect(err).NotTo(HaveOccurred())
+		head, _ := reopened.head("aa")
+		Expect(head.Command.CorrelationId).To(Equal("two"))
+		Expect(reopened.depth()).To(Equal(1))
+		Expect(reopened.push(bridge.Command{Device: "aa", IdempotencyKey: "k"})).To(BeFalse())
+	})
+})
+
+var _ = Describe("Device classes", func() {
+	It("holds Class A commands until an uplink when configured so", func() {
+		devices, err := writeAndLoadDeviceConfig(`{
+			"devices": {"aa": "sensor", "bb": "actuator"},
+			"classes": {"deviceTypes": {"actuator": "C"}, "classA": "uplink"}
+		}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(devices.waitsForUplink("aa")).To(BeTrue())
+		Expect(devices.waitsForUplink("cc")).To(BeTrue())
+		Expect(devices.waitsForUplink("bb")).To(BeFalse())
+	})
+
+	It("hands Class A commands to LRSC by default", func() {
+		devices, _ := writeAndLoadDeviceConfig(`{"devices": {"aa": "sensor"}}`)
+		Expect(devices.waitsForUplink("aa")).To(BeFalse())
+		Expect((*deviceConfig)(nil).waitsForUplink("aa")).To(BeFalse())
+	})
+
+	It("rejects unknown classes and releases", func() {
+		_, err := writeAndLoadDeviceConfig(`{"classes": {"deviceTypes": {"sensor": "B"}}}`)
+		Expect(err).To(MatchError("Invalid class of device type sensor: B, expected A or C"))
+
+		_, err = writeAndLoadDeviceConfig(`{"classes": {"classA": "later"}}`)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Releasing downlinks", func() {
+	var (
+		lrscClient *lrscConnection
+		written    []lrscMessage
+		writeFails bool
+		results    chan bridge.CommandResult
+	)
+
+	configure := func(config string) {
+		devices, err := writeAndLoadDeviceConfig(config)
+		Expect(err).NotTo(HaveOccurred())
+		lrscClient.devices = devices
+	}
+
+	payloads := func() (sent []string) {
+		for _, message := range written {
+			sent = append(sent, message.Payload)
+		}
+		return sent
+	}
+
+	BeforeEach(func() {
+		written = nil
+		writeFails = false
+		mockConn := &mockConnection{
+			writeFunc: func(s string) error {
+				if writeFails {
+					return os.ErrClosed
+				}
+				message, _ := parseLrscMessage(s)
+				written = append(written, message)
+				return nil
+			},
+		}
+
+		results = make(chan bridge.CommandResult, 10)
+		lrscClient = &lrscConnection{conn: newLineTransport(mockConn), StatusReporter: reporter.New()}
+		lrscClient.inbound = make(chan lrscMessage, 10)
+		lrscClient.results = results
+		lrscClient.downlinks, _ = openDownlinkQueue("")
+		lrscClient.connected = 1
+	})
+
+	It("sends commands right away by default", func() {
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "01"})
+
+		Expect(payloads()).To(Equal([]string{"01"}))
+		Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+		Expect((<-results).Status).To(Equal(bridge.CommandSent))
+		Expect(lrscClient.downlinks.depth()).To(Equal(0))
+		Expect(lrscClient.Summary()).To(ContainSubstring(`"DOWNLINK_QUEUE":"0"`))
+	})
+
+	It("sends one command of a Class A device after each uplink", func() {
+		configure(`{"classes": {"classA": "uplink"}}`)
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "01"})
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "02"})
+		Expect(written).To(BeEmpty())
+		Expect(lrscClient.Summary()).To(ContainSubstring(`"DOWNLINK_QUEUE":"2"`))
+
+		lrscClient.dispatch(&lrscMessage{Type: messageTypeUpstream, DeviceGuid: "aa"})
+		Expect(payloads()).To(Equal([]string{"01"}))
+
+		lrscClient.dispatch(&lrscMessage{Type: messageTypeUpstream, DeviceGuid: "bb"})
+		lrscClient.dispatch(&lrscMessage{Type: messageTypeUpstream, DeviceGuid: "aa"})
+		Expect(payloads()).To(Equal([]string{"01", "02"}))
+	})
+
+	It("sends commands of Class C devices right away", func() {
+		configure(`{"devices": {"aa": "actuator"}, "classes": {"deviceTypes": {"actuator": "C"}, "classA": "uplink"}}`)
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "01"})
+
+		Expect(payloads()).To(Equal([]string{"01"}))
+	})
+
+	It("reports commands as sent before their acknowledgement", func() {
+		lrscClient.pending = newPendingDownlinks(results)
+		lrscClient.conn = newLineTransport(&mockConnection{
+			writeFunc: func(s string) error {
+				message, _ := parseLrscMessage(s)
+				lrscClient.dispatch(&lrscDownstreamResult{Type: messageTypeDownstreamAck, UniqueSequenceNo: message.UniqueSequenceNo})
+				return nil
+			},
+		})
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "01", Confirmed: true})
+
+		Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+		Expect((<-results).Status).To(Equal(bridge.CommandSent))
+		Expect((<-results).Status).To(Equal(bridge.CommandDelivered))
+	})
+
+	It("sends the next command when the one being sent is cancelled", func() {
+		lrscClient.conn = newLineTransport(&mockConnection{
+			writeFunc: func(s string) error {
+				message, _ := parseLrscMessage(s)
+				written = append(written, message)
+				lrscClient.cancelCommand("one")
+				return nil
+			},
+		})
+		lrscClient.connected = 0
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "01", CorrelationId: "one"})
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "02", CorrelationId: "two"})
+
+		lrscClient.connected = 1
+		lrscClient.releaseQueuedDownlinks()
+		Expect(payloads()).To(Equal([]string{"01", "02"}))
+		Expect(lrscClient.downlinks.depth()).To(Equal(0))
+	})
+
+	It("keeps commands queued while LRSC is unreachable", func() {
+		lrscClient.connected = 0
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "01"})
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "02"})
+		Expect(written).To(BeEmpty())
+
+		lrscClient.connected = 1
+		lrscClient.releaseQueuedDownlinks()
+		Expect(payloads()).To(Equal([]string{"01", "02"}))
+	})
+
+	It("keeps commands queued that cannot be written", func() {
+		writeFails = true
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "01"})
+
+		Expect(lrscClient.downlinks.depth()).To(Equal(1))
+		Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+		Expect(results).NotTo(Receive())
+	})
+
+	It("reports commands ignored for their idempotency key", func() {
+		lrscClient.connected = 0
+		lrscClient.queueCommand(bridge.Command{Device: "aa", IdempotencyKey: "k"})
+		lrscClient.queueCommand(bridge.Command{Device: "aa", IdempotencyKey: "k"})
+
+		Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+		Expect((<-results).Status).To(Equal(bridge.CommandDuplicate))
+		Expect(results).NotTo(Receive())
+		Expect(lrscClient.downlinks.depth()).To(Equal(1))
+	})
+
+	It("drops expired commands instead of sending them", func() {
+		lrscClient.connected = 0
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "01", Expires: time.Now().Add(-time.Second)})
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "02"})
+
+		lrscClient.connected = 1
+		lrscClient.releaseQueuedDownlinks()
+		Expect(payloads()).To(Equal([]string{"02"}))
+
+		Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+		expired := <-results
+		Expect(expired.Status).To(Equal(bridge.CommandExpired))
+		Expect(expired.Command.Payload).To(Equal("01"))
+		Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+	})
+
+	It("cancels queued commands", func() {
+		lrscClient.connected = 0
+		lrscClient.queueCommand(bridge.Command{Device: "aa", CorrelationId: "c"})
+
+		Expect(lrscClient.cancelCommand("c")).To(BeTrue())
+		Expect(lrscClient.cancelCommand("c")).To(BeFalse())
+		Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+		Expect((<-results).Status).To(Equal(bridge.CommandCancelled))
+		Expect(lrscClient.downlinks.depth()).To(Equal(0))
+	})
+
+	Describe("with a duty cycle", func() {
+		BeforeEach(func() {
+			lrscClient.useRegionalPlan(&regionalPlan{
+				Bands:            []dutyCycleBand{{"test", 868000000, 869000000, 0.001}},
+				DefaultDataRate:  loraDataRate{SpreadingFactor: 12, Bandwidth: 125},
+				DefaultFrequency: 868100000,
+			})
+		})
+
+		It("delays commands until the duty cycle allows them", func() {
+			// 0.1% of an hour is 3.6s, SF12 downlinks of 40 bytes take 2.5s
+			payload := strings.Repeat("00", 40)
+			lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: payload})
+			lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: payload})
+			lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: payload})
+
+			Expect(written).To(HaveLen(1))
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+			Expect((<-results).Status).To(Equal(bridge.CommandSent))
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+			delayed := <-results
+			Expect(delayed.Status).To(Equal(bridge.CommandDelayed))
+			Expect(delayed.Reason).To(ContainSubstring("would exceed the duty cycle of device AA"))
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+			Expect(results).NotTo(Receive())
+			Expect(lrscClient.downlinks.depth()).To(Equal(2))
+			Expect(lrscClient.Summary()).To(ContainSubstring(`"DUTY_CYCLE"`))
+		})
+
+		It("fails commands that never fit into the duty cycle", func() {
+			lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: strings.Repeat("00", 100)})
+
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+			failed := <-results
+			Expect(failed.Status).To(Equal(bridge.CommandFailed))
+			Expect(failed.Reason).To(ContainSubstring("exceeds the duty cycle"))
+			Expect(lrscClient.downlinks.depth()).To(Equal(0))
+		})
+	})
+
+	It("rejects commands too long for the device's data rate", func() {
+		configure(`{"classes": {"classA": "uplink"}}`)
+		lrscClient.useRegionalPlan(eu868)
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: strings.Repeat("00", 52)})
+		lrscClient.dispatch(&lrscMessage{Type: messageTypeUpstream, DeviceGuid: "aa", Frequency: 868100000, DataRate: "SF10BW125"})
+
+		Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+		rejected := <-results
+		Expect(rejected.Status).To(Equal(bridge.CommandRejected))
+		Expect(rejected.Rejection.MaxLength).To(Equal(51))
+		Expect(rejected.Rejection.DataRate).To(Equal("SF10BW125"))
+		Expect(written).To(BeEmpty())
+	})
+
+	It("fails commands that cannot be encoded", func() {
+		configure(`{"codecs": {"default": "json"}}`)
+		deadLetters, _ := deadletter.Open("", 10)
+		lrscClient.deadLetters = deadLetters
+
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "not json"})
+		lrscClient.queueCommand(bridge.Command{Device: "aa", Payload: "{}"})
+
+		Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+		Expect((<-results).Status).To(Equal(bridge.CommandFailed))
+		Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+		Expect((<-results).Status).To(Equal(bridge.CommandSent))
+		Expect(deadLetters.List(bridge.StageDownlink)).To(HaveLen(1))
+		Expect(lrscClient.downlinks.depth()).To(Equal(0))
+	})
+})
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dutyCycleWindow = time.Hour
+
+// regionalPlan holds the duty cycle limits of a LoRaWAN region, the most
+// bytes a downlink can carry at each data rate, and the radio settings of
+// downlinks to devices no uplink was seen from
+type regionalPlan struct {
+	Name             string
+	Bands            []dutyCycleBand
+	MaxPayload       map[loraDataRate]int
+	DefaultDataRate  loraDataRate
+	DefaultFrequency uint64
+}
+
+// dutyCycleBand limits the share of time spent transmitting in a range of
+// frequencies, in Hz
+type dutyCycleBand struct {
+	Name                       string
+	MinFrequency, MaxFrequency uint64
+	DutyCycle                  float64
+}
+
+// eu868 follows the ETSI sub-bands; downlinks without a known uplink go out
+// in RX2
+var eu868 = &regionalPlan{
+	Name: "EU868",
+	Bands: []dutyCycleBand{
+		{"h1.2", 863000000, 865000000, 0.001},
+		{"h1.3", 865000000, 868000000, 0.01},
+		{"h1.4", 868000000, 868600000, 0.01},
+		{"h1.5", 868700000, 869200000, 0.001},
+		{"h1.6", 869400000, 869650000, 0.1},
+		{"h1.7", 869700000, 870000000, 0.01},
+	},
+	MaxPayload: map[loraDataRate]int{
+		{12, 125}: 51,
+		{11, 125}: 51,
+		{10, 125}: 51,
+		{9, 125}:  115,
+		{8, 125}:  222,
+		{7, 125}:  222,
+		{7, 250}:  222,
+	},
+	DefaultDataRate:  loraDataRate{SpreadingFactor: 12, Bandwidth: 125},
+	DefaultFrequency: 869525000,
+}
+
+var regionalPlans = map[string]*regionalPlan{"EU868": eu868}
+
+// findRegionalPlan returns the plan of a region, none for "none"
+func findRegionalPlan(region string) (*regionalPlan, error) {
+	if strings.EqualFold(region, "none") {
+		return nil, nil
+	}
+	plan, known := regionalPlans[strings.ToUpper(region)]
+	if !known {
+		return nil, fmt.Errorf("Unknown region %v, expected EU868 or none", region)
+	}
+	return plan, nil
+}
+
+// useRegionalPlan limits the downlinks of a connection by the duty cycle
+// and the payload sizes of a regional plan, not at all for none
+func (self *lrscConnection) useRegionalPlan(plan *regionalPlan) {
+	self.radios = newDeviceRadios()
+	self.dutyCycle = newDutyCycleTracker(plan, self.radios)
+	self.payloadLimits = newPayloadLimits(plan, self.radios)
+}
+
+func (self *regionalPlan) band(frequency uint64) (dutyCycleBand, bool) {
+	for _, band := range self.Bands {
+		if frequency >= band.MinFrequency && frequency < band.MaxFrequency {
+			return band, true
+		}
+	}
+	return dutyCycleBand{}, false
+}
+
+// dutyCycleTracker keeps the airtime of the downlinks sent to every device
+// and through every gateway in the last dutyCycleWindow. Downlinks sent
+// right after an uplink are assumed to go out like it: in its RX1 window,
+// through the same gateway, at the same frequency and data rate. All other
+// downlinks, to Class C devices or handed to LRSC to hold, go out in RX2 at
+// the plan's default frequency and data rate.
+type dutyCycleTracker struct {
+	lock   sync.Mutex
+	plan   *regionalPlan
+	radios *deviceRadios
+	usage  map[string][]airtimeUse
+	now    func() time.Time
+}
+
+type airtimeUse struct {
+	time    time.Time
+	airtime time.Duration
+}
+
+// downlinkAirtime is the airtime a downlink takes from the budgets it
+// was checked against
+type downlinkAirtime struct {
+	airtime time.Duration
+	budgets []string
+}
+
+// dutyCycleError rejects a downlink that does not fit into a budget, for
+// now when Wait is set and for good otherwise
+type dutyCycleError struct {
+	Budget  string
+	Airtime time.Duration
+	Wait    time.Duration
+}
+
+func (self dutyCycleError) Error() string {
+	if self.Wait == 0 {
+		return fmt.Sprintf("Airtime of %v exceeds the duty cycle of %v", self.Airtime, self.Budget)
+	}
+	return fmt.Sprintf("Airtime of %v would exceed the duty cycle of %v, possible again in %v", self.Airtime, self.Budget, self.Wait)
+}
+
+func newDutyCycleTracker(plan *regionalPlan, radios *deviceRadios) *dutyCycleTracker {
+	if plan == nil {
+		return nil
+	}
+	return &dutyCycleTracker{plan: plan, radios: radios, usage: make(map[string][]airtimeUse), now: time.Now}
+}
+
+// radio returns how downlinks to a device are sent and the band they are
+// sent in. Downlinks in RX2, to devices not heard yet or heard outside the
+// plan's bands use the plan's defaults.
+func (self *dutyCycleTracker) radio(device string, rx2 bool) (deviceRadio, dutyCycleBand) {
+	radio, heard := self.radios.radio(device)
+	if !heard || rx2 {
+		radio.dataRate = self.plan.DefaultDataRate
+		radio.frequency = self.plan.DefaultFrequency
+	}
+
+	band, known := self.plan.band(radio.frequency)
+	if !known {
+		radio.frequency = self.plan.DefaultFrequency
+		band, _ = self.plan.band(radio.frequency)
+	}
+	return radio, band
+}
+
+// check tells whether a downlink of payloadLength bytes, in RX2 or else in
+// RX1, fits into the budgets of its device and gateway
+func (self *dutyCycleTracker) check(device string, payloadLength int, rx2 bool) (downlinkAirtime, error) {
+	if self == nil {
+		return downlinkAirtime{}, nil
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	radio, band := self.radio(device, rx2)
+	downlink := downlinkAirtime{airtime: radio.dataRate.downlinkAirtime(payloadLength)}
+	downlink.budgets = append(downlink.budgets, fmt.Sprintf("device %v in band %v", strings.ToUpper(device), band.Name))
+	if radio.gateway != "" {
+		downlink.budgets = append(downlink.budgets, fmt.Sprintf("gateway %v in band %v", radio.gateway, band.Name))
+	}
+
+	budget := time.Duration(band.DutyCycle * float64(dutyCycleWindow))
+	for _, name := range downlink.budgets {
+		if err := self.fits(name, budget, downlink.airtime); err != nil {
+			return downlink, err
+		}
+	}
+	return downlink, nil
+}
+
+func (self *dutyCycleTracker) fits(name string, budget, airtime time.Duration) error {
+	if airtime > budget {
+		return dutyCycleError{Budget: name, Airtime: airtime}
+	}
+
+	now := self.now()
+	uses := self.recentUsage(name, now)
+
+	used := time.Duration(0)
+	for _, use := range uses {
+		used += use.airtime
+	}
+
+	// the budget frees up as the oldest downlinks leave the window
+	for _, use := range uses {
+		if used+airtime <= budget {
+			break
+		}
+		used -= use.airtime
+		if used+airtime <= budget {
+			return dutyCycleError{Budget: name, Airtime: airtime, Wait: use.time.Add(dutyCycleWindow).Sub(now)}
+		}
+	}
+	return nil
+}
+
+// record takes the airtime of a sent downlink from its budgets
+func (self *dutyCycleTracker) record(downlink downlinkAirtime) {
+	if self == nil {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.now()
+	for _, name := range downlink.budgets {
+		self.usage[name] = append(self.usage[name], airtimeUse{time: now, airtime: downlink.airtime})
+	}
+}
+
+// recentUsage drops the downlinks of a budget that left the window and
+// returns the others
+func (self *dutyCycleTracker) recentUsage(name string, now time.Time) []airtimeUse {
+	uses := self.usage[name]
+	for len(uses) > 0 && now.Sub(uses[0].time) >= dutyCycleWindow {
+		uses = uses[1:]
+	}
+
+	if len(uses) == 0 {
+		delete(self.usage, name)
+	} else {
+		self.usage[name] = uses
+	}
+	return uses
+}
+
+// prune forgets the budgets without downlinks in the window
+func (self *dutyCycleTracker) prune() {
+	if self == nil {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.now()
+	for name := range self.usage {
+		self.recentUsage(name, now)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Duty cycle", func() {
+	var (
+		tracker *dutyCycleTracker
+		radios  *deviceRadios
+		now     time.Time
+	)
+
+	uplink := func(device, gateway string, frequency uint64, dataRate string) {
+		radios.observeUplink(lrscMessage{DeviceGuid: device, GatewayEui: gateway, Frequency: frequency, DataRate: dataRate})
+	}
+
+	send := func(device string, length int) error {
+		airtime, err := tracker.check(device, length, false)
+		if err == nil {
+			tracker.record(airtime)
+		}
+		return err
+	}
+
+	BeforeEach(func() {
+		now = time.Now()
+		radios = newDeviceRadios()
+		tracker = newDutyCycleTracker(eu868, radios)
+		tracker.now = func() time.Time { return now }
+	})
+
+	It("finds the regional plans", func() {
+		Expect(findRegionalPlan("eu868")).To(Equal(eu868))
+		Expect(findRegionalPlan("none")).To(BeNil())
+
+		_, err := findRegionalPlan("XX915")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("takes the airtime of downlinks from the budget of their band", func() {
+		// 1% of an hour in h1.4 is 36s, SF12 downlinks of 51 bytes take 2.79s
+		uplink("aa", "", 868100000, "SF12BW125")
+		for i := 0; i < 12; i++ {
+			Expect(send("aa", 51)).To(Succeed())
+		}
+
+		err := send("aa", 51)
+		Expect(err).To(BeAssignableToTypeOf(dutyCycleError{}))
+		Expect(err.(dutyCycleError).Budget).To(Equal("device AA in band h1.4"))
+		Expect(err.(dutyCycleError).Wait).To(Equal(time.Hour))
+	})
+
+	It("frees the budget as downlinks leave the window", func() {
+		uplink("aa", "", 868100000, "SF12BW125")
+		for i := 0; i < 12; i++ {
+			send("aa", 51)
+			now = now.Add(time.Minute)
+		}
+
+		err := send("aa", 51)
+		Expect(err.(dutyCycleError).Wait).To(Equal(48 * time.Minute))
+
+		now = now.Add(48 * time.Minute)
+		Expect(send("aa", 51)).To(Succeed())
+	})
+
+	It("shares the budget of a gateway between its devices", func() {
+		uplink("aa", "GW", 868100000, "SF12BW125")
+		uplink("bb", "GW", 868100000, "SF12BW125")
+		for i := 0; i < 6; i++ {
+			Expect(send("aa", 51)).To(Succeed())
+			Expect(send("bb", 51)).To(Succeed())
+		}
+
+		// the devices have budget left, the gateway does not
+		err := send("aa", 51)
+		Expect(err.(dutyCycleError).Budget).To(Equal("gateway GW in band h1.4"))
+
+		uplink("aa", "OTHER", 868100000, "SF12BW125")
+		Expect(send("aa", 51)).To(Succeed())
+	})
+
+	It("sends downlinks to unheard devices in RX2", func() {
+		// 10% of an hour in h1.6 allows many more SF12 downlinks
+		for i := 0; i < 100; i++ {
+			Expect(send("aa", 51)).To(Succeed())
+		}
+	})
+
+	It("charges downlinks in RX2 at the plan's defaults", func() {
+		uplink("aa", "GW", 868100000, "SF7BW125")
+		airtime, err := tracker.check("aa", 51, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(airtime.airtime).To(Equal(loraDataRate{12, 125}.downlinkAirtime(51)))
+		Expect(airtime.budgets).To(Equal([]string{"device AA in band h1.6", "gateway GW in band h1.6"}))
+	})
+
+	It("forgets budgets whose downlinks left the window", func() {
+		uplink("aa", "GW", 868100000, "SF12BW125")
+		send("aa", 51)
+		Expect(tracker.usage).To(HaveLen(2))
+
+		now = now.Add(dutyCycleWindow)
+		tracker.prune()
+		Expect(tracker.usage).To(BeEmpty())
+	})
+
+	It("rejects downlinks that never fit into the budget", func() {
+		tracker.plan = &regionalPlan{
+			Bands:            []dutyCycleBand{{"tiny", 868000000, 869000000, 0.0001}},
+			DefaultDataRate:  loraDataRate{SpreadingFactor: 12, Bandwidth: 125},
+			DefaultFrequency: 868100000,
+		}
+
+		err := send("aa", 51)
+		Expect(err.(dutyCycleError).Wait).To(BeZero())
+		Expect(err).To(MatchError("Airtime of 2.793472s exceeds the duty cycle of device AA in band tiny"))
+	})
+
+	It("does nothing without a regional plan", func() {
+		tracker = newDutyCycleTracker(nil, radios)
+		uplink("aa", "", 868100000, "SF12BW125")
+		Expect(send("aa", 1000)).To(Succeed())
+	})
+})
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/iotf"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fragmentation follows the LoRa Alliance Fragmented Data Block Transport
+// specification (TS004) without forward error correction. A command is sent
+// as a FragSessionSetupReq, whose descriptor carries the command's port,
+// the numbered DataFragments and a FragStatusReq asking the device what it
+// missed. Devices fragment their uplinks the same way, announcing each
+// session with a FragSessionSetupReq of their own.
+const (
+	defaultFragmentationPort    uint = 201
+	defaultFragmentSize              = 48
+	defaultFragmentationTimeout      = 10 * time.Minute
+
+	fragStatusCid       = 0x01
+	fragSessionSetupCid = 0x02
+	dataFragmentCid     = 0x08
+
+	fragSessionSetupLength    = 11
+	fragSessionSetupAnsLength = 2
+	fragStatusAnsLength       = 5
+	dataFragmentHeaderLength  = 3
+
+	maxFragmentSessions = 4
+	maxFragments        = 1<<14 - 1
+	maxFragmentSize     = 255
+
+	fragmentationEventName = "fragmentation"
+)
+
+var errFragmentSessionsBusy = errors.New("all fragmentation sessions of the device are busy")
+
+// fragmentationConfig lists the device types that take oversize commands in
+// fragments and may fragment their uplinks
+type fragmentationConfig struct {
+	DeviceTypes  []string `json:"deviceTypes"`
+	Port         uint     `json:"port"`
+	FragmentSize int      `json:"fragmentSize"`
+	Timeout      string   `json:"timeout"`
+
+	timeout time.Duration
+}
+
+func (self *fragmentationConfig) validate() error {
+	if self.Port != 0 && !validApplicationPort(self.Port) {
+		return fmt.Errorf("Invalid fragmentation port: %v", self.Port)
+	}
+	if self.FragmentSize < 0 || self.FragmentSize > maxFragmentSize {
+		return fmt.Errorf("Invalid fragment size: %v, expected at most %v bytes", self.FragmentSize, maxFragmentSize)
+	}
+	if self.Timeout != "" {
+		timeout, err := time.ParseDuration(self.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("Invalid fragmentation timeout: %v", self.Timeout)
+		}
+		self.timeout = timeout
+	}
+	return nil
+}
+
+// fragmented tells whether a device takes and sends fragmented payloads
+func (self *deviceConfig) fragmented(device string) bool {
+	if self == nil {
+		return false
+	}
+	deviceType := self.deviceType(device)
+	for _, fragmented := range self.Fragmentation.DeviceTypes {
+		if deviceType != "" && fragmented == deviceType {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *deviceConfig) fragmentationPort() uint {
+	if self == nil || self.Fragmentation.Port == 0 {
+		return defaultFragmentationPort
+	}
+	return self.Fragmentation.Port
+}
+
+func (self *deviceConfig) fragmentSize() int {
+	if self == nil || self.Fragmentation.FragmentSize == 0 {
+		return defaultFragmentSize
+	}
+	return self.Fragmentation.FragmentSize
+}
+
+func (self *deviceConfig) fragmentationTimeout() time.Duration {
+	if self == nil || self.Fragmentation.timeout == 0 {
+		return defaultFragmentationTimeout
+	}
+	return self.Fragmentation.timeout
+}
+
+// fragmentedDownlink holds the hex encoded frames of a command sent in
+// fragments and how many of them were sent
+type fragmentedDownlink struct {
+	Session   int      `json:"session"`
+	Fragments int      `json:"fragments"`
+	Frames    []string `json:"frames"`
+	Sent      int      `json:"sent"`
+}
+
+// fragmentFrames splits data into the frames of a fragmentation session:
+// the session setup, the fragments and the status request
+func fragmentFrames(session int, port uint, data []byte, size int) ([]string, error) {
+	count := (len(data) + size - 1) / size
+	if count > maxFragments {
+		return nil, fmt.Errorf("%v bytes take more than %v fragments of %v bytes", len(data), maxFragments, size)
+	}
+	padding := count*size - len(data)
+
+	setup := make([]byte, fragSessionSetupLength)
+	setup[0] = fragSessionSetupCid
+	setup[1] = byte(session << 4)
+	binary.LittleEndian.PutUint16(setup[2:], uint16(count))
+	setup[4] = byte(size)
+	setup[5] = 0 // no coding, no block ack delay
+	setup[6] = byte(padding)
+	binary.LittleEndian.PutUint32(setup[7:], uint32(port))
+	frames := []string{hex.EncodeToString(setup)}
+
+	padded := make([]byte, count*size)
+	copy(padded, data)
+	for n := 1; n <= count; n++ {
+		fragment := make([]byte, dataFragmentHeaderLength, dataFragmentHeaderLength+size)
+		fragment[0] = dataFragmentCid
+		binary.LittleEndian.PutUint16(fragment[1:], uint16(session<<14|n))
+		fragment = append(fragment, padded[(n-1)*size:n*size]...)
+		frames = append(frames, hex.EncodeToString(fragment))
+	}
+
+	// all participants answer, not only those missing fragments
+	status := []byte{fragStatusCid, byte(session<<1 | 1)}
+	return append(frames, hex.EncodeToString(status)), nil
+}
+
+type fragmentSessionSetup struct {
+	session   int
+	fragments int
+	size      int
+	padding   int
+	port      uint
+}
+
+func parseFragmentSessionSetup(frame []byte) fragmentSessionSetup {
+	return fragmentSessionSetup{
+		session:   int(frame[1]>>4) & 0x03,
+		fragments: int(binary.LittleEndian.Uint16(frame[2:])),
+		size:      int(frame[4]),
+		padding:   int(frame[6]),
+		port:      uint(binary.LittleEndian.Uint32(frame[7:])),
+	}
+}
+
+// fragmentSetupError is a device's refusal of a fragmentation session
+type fragmentSetupError struct {
+	Session int
+	Status  byte
+}
+
+func (self fragmentSetupError) Error() string {
+	var reasons []string
+	for bit, reason := range []string{"encoding unsupported", "not enough memory", "session index not supported", "wrong descriptor"} {
+		if self.Status&(1<<uint(bit)) != 0 {
+			reasons = append(reasons, reason)
+		}
+	}
+	return fmt.Sprintf("Device refused fragmentation session %v: %v", self.Session, strings.Join(reasons, ", "))
+}
+
+// fragmentationStatus reports the fragments of a session that did not arrive
+type fragmentationStatus struct {
+	Session   int   `json:"session"`
+	Fragments int   `json:"fragments"`
+	Received  int   `json:"received"`
+	Missing   []int `json:"missing"`
+
+	device string
+}
+
+func (self fragmentationStatus) event() iotf.Event {
+	payload, _ := json.Marshal(self)
+	return iotf.Event{Device: self.device, Name: fragmentationEventName, Payload: string(payload)}
+}
+
+// fragmentSessions reassembles fragmented uplinks and follows fragmented
+// commands until their devices report what they received
+type fragmentSessions struct {
+	lock      sync.Mutex
+	uplinks   map[string]*uplinkSession
+	downlinks map[string]*downlinkSession
+	next      map[string]int
+	now       func() time.Time
+}
+
+type uplinkSession struct {
+	device   string
+	setup    fragmentSessionSetup
+	received map[int][]byte
+	updated  time.Time
+}
+
+type downlinkSession struct {
+	command   bridge.Command
+	fragments int
+	// updated is when the session was set up or its last frame was sent
+	updated time.Time
+	sent    bool
+}
+
+func newFragmentSessions() *fragmentSessions {
+	return &fragmentSessions{
+		uplinks:   make(map[string]*uplinkSession),
+		downlinks: make(map[string]*downlinkSession),
+		next:      make(map[string]int),
+		now:       time.Now,
+	}
+}
+
+func sessionKey(device string, session int) string {
+	return fmt.Sprintf("%v %v", strings.ToUpper(device), session)
+}
+
+// startDownlink picks the session of a command, taking turns with the
+// sessions a device supports and skipping those still in use
+func (self *fragmentSessions) startDownlink(command bridge.Command, fragments int) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	device := strings.ToUpper(command.Device)
+	for i := 0; i < maxFragmentSessions; i++ {
+		session := (self.next[device] + i) % maxFragmentSessions
+		key := sessionKey(device, session)
+		if _, busy := self.downlinks[key]; busy {
+			continue
+		}
+
+		self.next[device] = (session + 1) % maxFragmentSessions
+		self.downlinks[key] = &downlinkSession{command: command, fragments: fragments, updated: self.now()}
+		return session, nil
+	}
+	return 0, errFragmentSessionsBusy
+}
+
+// restoreDownlink resumes the session of a command fragmented before a
+// restart, so that its remaining frames and its device's status find it
+func (self *fragmentSessions) restoreDownlink(command bridge.Command, session, fragments int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	device := strings.ToUpper(command.Device)
+	self.downlinks[sessionKey(device, session)] = &downlinkSession{command: command, fragments: fragments, updated: self.now()}
+	self.next[device] = (session + 1) % maxFragmentSessions
+}
+
+// downlinkSent notes that a frame of a session was sent, and starts waiting
+// for the device's status after the last one
+func (self *fragmentSessions) downlinkSent(command bridge.Command, session int, last bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	downlink, present := self.downlinks[sessionKey(command.Device, session)]
+	if !present || downlink.command.CorrelationId != command.CorrelationId {
+		return
+	}
+	downlink.updated = self.now()
+	downlink.sent = last
+}
+
+// dropDownlink ends the session of a command that will not be sent
+func (self *fragmentSessions) dropDownlink(command bridge.Command) {
+	if self == nil {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for key, downlink := range self.downlinks {
+		if downlink.command.CorrelationId == command.CorrelationId && strings.EqualFold(downlink.command.Device, command.Device) {
+			delete(self.downlinks, key)
+		}
+	}
+}
+
+func (self *fragmentSessions) finishDownlink(device string, session int) (*downlinkSession, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	key := sessionKey(device, session)
+	downlink, present := self.downlinks[key]
+	delete(self.downlinks, key)
+	return downlink, present
+}
+
+// startUplink starts reassembling a session announced by a device, dropping
+// an unfinished one with the same index
+func (self *fragmentSessions) startUplink(device string, setup fragmentSessionSetup) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.uplinks[sessionKey(device, setup.session)] = &uplinkSession{
+		device:   device,
+		setup:    setup,
+		received: make(map[int][]byte),
+		updated:  self.now(),
+	}
+}
+
+// addFragment keeps an uplink fragment and returns the reassembled data and
+// its port once the session is complete
+func (self *fragmentSessions) addFragment(device string, session, n int, data []byte) ([]byte, uint, bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	key := sessionKey(device, session)
+	uplink, present := self.uplinks[key]
+	switch {
+	case !present:
+		return nil, 0, false, fmt.Errorf("fragment %v of unknown session %v", n, session)
+	case n < 1 || n > uplink.setup.fragments:
+		return nil, 0, false, fmt.Errorf("fragment %v beyond the %v fragments of session %v", n, uplink.setup.fragments, session)
+	case len(data) != uplink.setup.size:
+		return nil, 0, false, fmt.Errorf("fragment %v of session %v has %v bytes instead of %v", n, session, len(data), uplink.setup.size)
+	}
+
+	uplink.received[n] = data
+	uplink.updated = self.now()
+	if len(uplink.received) < uplink.setup.fragments {
+		return nil, 0, false, nil
+	}
+
+	delete(self.uplinks, key)
+	var assembled []byte
+	for i := 1; i <= uplink.setup.fragments; i++ {
+		assembled = append(assembled, uplink.received[i]...)
+	}
+	if uplink.setup.padding <= len(assembled) {
+		assembled = assembled[:len(assembled)-uplink.setup.padding]
+	}
+	return assembled, uplink.setup.port, true, nil
+}
+
+// expire drops the uplink sessions that saw no fragment within timeout, and
+// the downlink sessions that sent no frame or got no status within timeout
+// of being set up or sending their last frame
+func (self *fragmentSessions) expire(timeout time.Duration) ([]fragmentationStatus, []*downlinkSession) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var incomplete []fragmentationStatus
+	for key, uplink := range self.uplinks {
+		if self.now().Sub(uplink.updated) < timeout {
+			continue
+		}
+		delete(self.uplinks, key)
+
+		status := fragmentationStatus{
+			Session:   uplink.setup.session,
+			Fragments: uplink.setup.fragments,
+			Received:  len(uplink.received),
+			Missing:   []int{},
+			device:    uplink.device,
+		}
+		for n := 1; n <= uplink.setup.fragments; n++ {
+			if _, received := uplink.received[n]; !received {
+				status.Missing = append(status.Missing, n)
+			}
+		}
+		incomplete = append(incomplete, status)
+	}
+	sort.Sort(byDeviceAndSession(incomplete))
+
+	var unanswered []*downlinkSession
+	for key, downlink := range self.downlinks {
+		if self.now().Sub(downlink.updated) >= timeout {
+			delete(self.downlinks, key)
+			unanswered = append(unanswered, downlink)
+		}
+	}
+	return incomplete, unanswered
+}
+
+type byDeviceAndSession []fragmentationStatus
+
+func (self byDeviceAndSession) Len() int      { return len(self) }
+func (self byDeviceAndSession) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self byDeviceAndSession) Less(i, j int) bool {
+	return sessionKey(self[i].device, self[i].Session) < sessionKey(self[j].device, self[j].Session)
+}
+
+// fragmentsCommands tells whether oversize commands to a device are sent in
+// fragments rather than rejected
+func (self *lrscConnection) fragmentsCommands(device string) bool {
+	return self.fragments != nil && self.devices.fragmented(device)
+}
+
+// fragmentCommand replaces a queued command with the frames of a
+// fragmentation session. It fails when the fragments would not fit the
+// device's data rate, and with errFragmentSessionsBusy while the device has
+// no session free.
+func (self *lrscConnection) fragmentCommand(command bridge.Command) error {
+	port := self.devices.commandPort(command.Device, command.Name)
+	pdu, err := self.devices.encodeCommand(command.Device, port, command.Payload)
+	if err != nil {
+		return commandEncodingError{err}
+	}
+	data, _ := hex.DecodeString(pdu)
+
+	size := self.devices.fragmentSize()
+	err = self.payloadLimits.check(command.Device, dataFragmentHeaderLength+size, !self.devices.waitsForUplink(command.Device))
+	if err != nil {
+		return err
+	}
+
+	fragments := (len(data) + size - 1) / size
+	session, err := self.fragments.startDownlink(command, fragments)
+	if err != nil {
+		return err
+	}
+	frames, err := fragmentFrames(session, port, data, size)
+	if err != nil {
+		logger.Error("Could not fragment command %v for %v: %v", command.CorrelationId, command.Device, err)
+		self.fragments.finishDownlink(command.Device, session)
+		return err
+	}
+
+	logger.Info("Sending command %v for %v in %v fragments, session %v", command.CorrelationId, command.Device, fragments, session)
+	self.downlinks.fragment(command, &fragmentedDownlink{Session: session, Fragments: fragments, Frames: frames})
+	return nil
+}
+
+// restoreFragments resumes the sessions of the fragmented commands in the
+// downlink queue, which unlike the sessions is kept across restarts
+func (self *lrscConnection) restoreFragments() {
+	for _, queued := range self.downlinks.list() {
+		for _, downlink := range queued {
+			if fragmented := downlink.Fragmented; fragmented != nil {
+				self.fragments.restoreDownlink(downlink.Command, fragmented.Session, fragmented.Fragments)
+			}
+		}
+	}
+}
+
+// sendFragment sends the next frame of a fragmented command. The device's
+// fragmentation status confirms the command instead of LRSC.
+func (self *lrscConnection) sendFragment(command bridge.Command, fragmented *fragmentedDownlink) error {
+	frame := fragmented.Frames[fragmented.Sent]
+	err := self.payloadLimits.check(command.Device, len(frame)/2, !self.devices.waitsForUplink(command.Device))
+	if err != nil {
+		self.Report("PAYLOAD_SIZE", fmt.Sprintf("%v: %v", command.Device, err))
+		return err
+	}
+
+	command.Confirmed = false
+	return self.sendDownlink(command, self.devices.fragmentationPort(), frame)
+}
+
+// eventsFromUplink returns the IoTF events of an uplink; fragments yield
+// the event of their reassembled uplink once it is complete
+func (self *lrscConnection) eventsFromUplink(message lrscMessage) []iotf.Event {
+	if self.fragments == nil || message.Port != self.devices.fragmentationPort() || !self.devices.fragmented(message.DeviceGuid) {
+		return []iotf.Event{self.eventFromUplink(message)}
+	}
+
+	frame, err := hex.DecodeString(message.Payload)
+	switch {
+	case err != nil || len(frame) == 0:
+		self.fragmentationFailed(message.DeviceGuid, fmt.Errorf("invalid message %q", message.Payload))
+	case frame[0] == dataFragmentCid && len(frame) > dataFragmentHeaderLength:
+		return self.receiveFragment(message, frame)
+	case frame[0] == fragSessionSetupCid && len(frame) == fragSessionSetupLength:
+		setup := parseFragmentSessionSetup(frame)
+		logger.Debug("%v starts fragmentation session %v of %v fragments", message.DeviceGuid, setup.session, setup.fragments)
+		self.fragments.startUplink(message.DeviceGuid, setup)
+	case frame[0] == fragSessionSetupCid && len(frame) == fragSessionSetupAnsLength:
+		self.receiveFragmentSetupAnswer(message.DeviceGuid, frame[1])
+	case frame[0] == fragStatusCid && len(frame) == fragStatusAnsLength:
+		self.receiveFragmentStatus(message.DeviceGuid, frame)
+	default:
+		self.fragmentationFailed(message.DeviceGuid, fmt.Errorf("unexpected message %v", message.Payload))
+	}
+	return nil
+}
+
+func (self *lrscConnection) receiveFragment(message lrscMessage, frame []byte) []iotf.Event {
+	index := binary.LittleEndian.Uint16(frame[1:])
+	session, n := int(index>>14), int(index&maxFragments)
+
+	data, port, complete, err := self.fragments.addFragment(message.DeviceGuid, session, n, frame[dataFragmentHeaderLength:])
+	if err != nil {
+		self.fragmentationFailed(message.DeviceGuid, err)
+		return nil
+	}
+	if !complete {
+		return nil
+	}
+
+	logger.Debug("Reassembled %v bytes from %v, session %v", len(data), message.DeviceGuid, session)
+	message.Port = port
+	message.Payload = hex.EncodeToString(data)
+	return []iotf.Event{self.eventFromUplink(message)}
+}
+
+// receiveFragmentSetupAnswer fails a command whose device refused its
+// session, along with the frames not sent yet
+func (self *lrscConnection) receiveFragmentSetupAnswer(device string, status byte) {
+	session := int(status >> 6)
+	if status&0x0f == 0 {
+		logger.Debug("%v accepted fragmentation session %v", device, session)
+		return
+	}
+
+	downlink, known := self.fragments.finishDownlink(device, session)
+	if !known {
+		self.fragmentationFailed(device, fragmentSetupError{Session: session, Status: status})
+		return
+	}
+
+	self.downlinks.cancel(downlink.command.CorrelationId)
+	self.reportDownlinks()
+	self.failCommand(downlink.command, fragmentSetupError{Session: session, Status: status})
+}
+
+// receiveFragmentStatus completes a fragmented command with the status its
+// device reported
+func (self *lrscConnection) receiveFragmentStatus(device string, frame []byte) {
+	index := binary.LittleEndian.Uint16(frame[1:])
+	session, received := int(index>>14), int(index&maxFragments)
+	missing, outOfMemory := int(frame[3]), frame[4]&0x01 != 0
+
+	downlink, known := self.fragments.finishDownlink(device, session)
+	if !known {
+		logger.Warning("Ignoring status of unknown fragmentation session %v from %v", session, device)
+		return
+	}
+
+	result := bridge.CommandResult{Command: downlink.command, Status: bridge.CommandDelivered}
+	switch {
+	case outOfMemory:
+		result.Status = bridge.CommandFailed
+		result.Reason = "device ran out of memory for the fragments"
+	case missing > 0:
+		result.Status = bridge.CommandFailed
+		result.Reason = fmt.Sprintf("device is missing %v of %v fragments", missing, downlink.fragments)
+	}
+	logger.Debug("%v received %v fragments of session %v, %v missing", device, received, session, missing)
+	self.results <- result
+}
+
+// expireFragments drops the sessions that timed out and returns the events
+// reporting the fragments missing from uplinks
+func (self *lrscConnection) expireFragments() []iotf.Event {
+	if self.fragments == nil {
+		return nil
+	}
+
+	incomplete, unanswered := self.fragments.expire(self.devices.fragmentationTimeout())
+
+	var events []iotf.Event
+	for _, status := range incomplete {
+		self.fragmentationFailed(status.device, fmt.Errorf("session %v timed out missing fragments %v", status.Session, status.Missing))
+		events = append(events, status.event())
+	}
+	for _, downlink := range unanswered {
+		if downlink.sent {
+			self.results <- bridge.CommandResult{Command: downlink.command, Status: bridge.CommandTimedOut, Reason: "no fragmentation status received"}
+			continue
+		}
+
+		// commands that are no longer queued were reported already
+		if _, queued := self.downlinks.cancel(downlink.command.CorrelationId); queued {
+			self.reportDownlinks()
+			self.results <- bridge.CommandResult{Command: downlink.command, Status: bridge.CommandTimedOut, Reason: "fragments not sent in time"}
+		}
+	}
+	return events
+}
+
+func (self *lrscConnection) fragmentationFailed(device string, err error) {
+	logger.Warning("Fragmentation with %v failed: %v", device, err)
+	self.Report("FRAGMENTATION", fmt.Sprintf("%v: %v", device, err))
+}
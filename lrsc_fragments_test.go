@@ -0,0 +1,370 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const fragmentingDevices = `{
+	"devices": {"aa": "valve"},
+	"fragmentation": {"deviceTypes": ["valve"], "timeout": "1m"}
+}`
+
+var _ = Describe("Fragmentation", func() {
+	It("splits data into a session setup, fragments and a status request", func() {
+		data := make([]byte, 100)
+		data[0], data[99] = 0xab, 0xcd
+
+		frames, err := fragmentFrames(1, 3, data, 48)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(frames).To(HaveLen(5))
+
+		// 3 fragments of 48 bytes, 44 of them padding, for port 3
+		Expect(frames[0]).To(Equal("0210030030002c03000000"))
+		Expect(frames[1]).To(HavePrefix("080140ab"))
+		Expect(frames[2]).To(HavePrefix("080240"))
+		Expect(frames[3]).To(HavePrefix("080340" + strings.Repeat("00", 3) + "cd"))
+		Expect(frames[3]).To(HaveLen(2 * (3 + 48)))
+		Expect(frames[4]).To(Equal("0103"))
+	})
+
+	It("refuses data that takes too many fragments", func() {
+		_, err := fragmentFrames(0, 3, make([]byte, maxFragments+1), 1)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("validates its configuration", func() {
+		_, err := writeAndLoadDeviceConfig(`{"fragmentation": {"port": 250}}`)
+		Expect(err).To(MatchError("Invalid fragmentation port: 250"))
+
+		_, err = writeAndLoadDeviceConfig(`{"fragmentation": {"fragmentSize": 300}}`)
+		Expect(err).To(HaveOccurred())
+
+		_, err = writeAndLoadDeviceConfig(`{"fragmentation": {"timeout": "soon"}}`)
+		Expect(err).To(MatchError("Invalid fragmentation timeout: soon"))
+
+		devices, err := writeAndLoadDeviceConfig(fragmentingDevices)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devices.fragmented("AA")).To(BeTrue())
+		Expect(devices.fragmented("bb")).To(BeFalse())
+		Expect(devices.fragmentationPort()).To(Equal(defaultFragmentationPort))
+		Expect(devices.fragmentationTimeout()).To(Equal(time.Minute))
+	})
+
+	Describe("uplinks", func() {
+		var (
+			lrscClient *lrscConnection
+			now        time.Time
+		)
+
+		uplink := func(pdu string) lrscMessage {
+			return lrscMessage{DeviceGuid: "aa", Port: defaultFragmentationPort, Payload: pdu}
+		}
+
+		BeforeEach(func() {
+			now = time.Now()
+			lrscClient = &lrscConnection{StatusReporter: reporter.New(), fragments: newFragmentSessions()}
+			lrscClient.fragments.now = func() time.Time { return now }
+			lrscClient.devices, _ = writeAndLoadDeviceConfig(fragmentingDevices)
+
+			// session 2 of 3 fragments of 4 bytes, 1 of them padding, for port 5
+			Expect(lrscClient.eventsFromUplink(uplink("02200300040001" + "05000000"))).To(BeEmpty())
+		})
+
+		It("reassembles the fragments of a session in any order", func() {
+			Expect(lrscClient.eventsFromUplink(uplink("080380" + "0a0b0000"))).To(BeEmpty())
+			Expect(lrscClient.eventsFromUplink(uplink("080180" + "01020304"))).To(BeEmpty())
+			Expect(lrscClient.eventsFromUplink(uplink("080180" + "01020304"))).To(BeEmpty())
+
+			events := lrscClient.eventsFromUplink(uplink("080280" + "05060708"))
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Name).To(Equal("5"))
+			Expect(events[0].Payload).To(MatchJSON(`{"payload":"0102030405060708` + `0a0b00"}`))
+		})
+
+		It("reports the fragments missing when a session times out", func() {
+			lrscClient.eventsFromUplink(uplink("080280" + "05060708"))
+
+			now = now.Add(59 * time.Second)
+			Expect(lrscClient.expireFragments()).To(BeEmpty())
+
+			now = now.Add(time.Minute)
+			events := lrscClient.expireFragments()
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Name).To(Equal(fragmentationEventName))
+			Expect(events[0].Payload).To(MatchJSON(`{"session":2,"fragments":3,"received":1,"missing":[1,3]}`))
+			Expect(lrscClient.Summary()).To(ContainSubstring("session 2 timed out missing fragments [1 3]"))
+
+			Expect(lrscClient.eventsFromUplink(uplink("080180" + "01020304"))).To(BeEmpty())
+			Expect(lrscClient.Summary()).To(ContainSubstring("fragment 1 of unknown session 2"))
+		})
+
+		It("ignores fragments that do not fit the session", func() {
+			Expect(lrscClient.eventsFromUplink(uplink("080480" + "01020304"))).To(BeEmpty())
+			Expect(lrscClient.eventsFromUplink(uplink("080180" + "0102"))).To(BeEmpty())
+			Expect(lrscClient.Summary()).To(ContainSubstring("has 2 bytes instead of 4"))
+		})
+
+		It("publishes uplinks on other ports and of other devices as usual", func() {
+			events := lrscClient.eventsFromUplink(lrscMessage{DeviceGuid: "aa", Port: 1, Payload: "01"})
+			Expect(events).To(HaveLen(1))
+
+			events = lrscClient.eventsFromUplink(lrscMessage{DeviceGuid: "bb", Port: defaultFragmentationPort, Payload: "01"})
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Name).To(Equal("201"))
+		})
+	})
+
+	Describe("commands", func() {
+		var (
+			lrscClient *lrscConnection
+			written    []lrscMessage
+			results    chan bridge.CommandResult
+			command    bridge.Command
+		)
+
+		BeforeEach(func() {
+			written = nil
+			mockConn := &mockConnection{
+				writeFunc: func(s string) error {
+					message, _ := parseLrscMessage(s)
+					written = append(written, message)
+					return nil
+				},
+			}
+
+			results = make(chan bridge.CommandResult, 20)
+			lrscClient = &lrscConnection{conn: newLineTransport(mockConn), StatusReporter: reporter.New()}
+			lrscClient.results = results
+			lrscClient.downlinks, _ = openDownlinkQueue("")
+			lrscClient.connected = 1
+			lrscClient.useRegionalPlan(eu868)
+			lrscClient.fragments = newFragmentSessions()
+			lrscClient.devices, _ = writeAndLoadDeviceConfig(fragmentingDevices)
+
+			command = bridge.Command{Device: "aa", Payload: strings.Repeat("00", 100), CorrelationId: "c", Confirmed: true}
+		})
+
+		It("sends oversize commands in fragments", func() {
+			lrscClient.queueCommand(command)
+
+			Expect(written).To(HaveLen(5))
+			for _, message := range written {
+				Expect(message.Port).To(Equal(defaultFragmentationPort))
+				Expect(message.Mode).To(Equal(messageModeUnconfirmed))
+			}
+			Expect(written[0].Payload).To(Equal("0200030030002c0a000000"))
+			Expect(written[4].Payload).To(Equal("0101"))
+
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+			Expect((<-results).Status).To(Equal(bridge.CommandSent))
+			Expect(lrscClient.downlinks.depth()).To(Equal(0))
+		})
+
+		It("completes commands with the fragmentation status of their device", func() {
+			lrscClient.queueCommand(command)
+			lrscClient.queueCommand(command)
+			for i := 0; i < 4; i++ {
+				<-results
+			}
+
+			lrscClient.eventsFromUplink(lrscMessage{DeviceGuid: "aa", Port: defaultFragmentationPort, Payload: "01030000" + "00"})
+			Expect((<-results).Status).To(Equal(bridge.CommandDelivered))
+
+			lrscClient.eventsFromUplink(lrscMessage{DeviceGuid: "aa", Port: defaultFragmentationPort, Payload: "01014002" + "00"})
+			failed := <-results
+			Expect(failed.Status).To(Equal(bridge.CommandFailed))
+			Expect(failed.Reason).To(Equal("device is missing 2 of 3 fragments"))
+		})
+
+		It("times commands out whose device reports no status", func() {
+			now := time.Now()
+			lrscClient.fragments.now = func() time.Time { return now }
+			lrscClient.queueCommand(command)
+			<-results
+			<-results
+
+			now = now.Add(time.Minute)
+			Expect(lrscClient.expireFragments()).To(BeEmpty())
+			Expect((<-results).Status).To(Equal(bridge.CommandTimedOut))
+		})
+
+		It("does not wait for the results to be read", func() {
+			now := time.Now()
+			lrscClient.fragments.now = func() time.Time { return now }
+			lrscClient.results = bufferResults(make(chan bridge.CommandResult))
+
+			done := make(chan struct{})
+			go func() {
+				lrscClient.queueCommand(command)
+				lrscClient.eventsFromUplink(lrscMessage{DeviceGuid: "aa", Port: defaultFragmentationPort, Payload: "01030000" + "00"})
+
+				command.CorrelationId = "d"
+				lrscClient.queueCommand(command)
+				now = now.Add(time.Minute)
+				lrscClient.expireFragments()
+				close(done)
+			}()
+
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("sends a fragment after each uplink of a Class A device", func() {
+			lrscClient.devices, _ = writeAndLoadDeviceConfig(`{
+				"devices": {"aa": "valve"},
+				"classes": {"classA": "uplink"},
+				"fragmentation": {"deviceTypes": ["valve"], "fragmentSize": 60}
+			}`)
+			lrscClient.inbound = make(chan lrscMessage, 10)
+			command.Payload = strings.Repeat("00", 200)
+			lrscClient.queueCommand(command)
+			Expect(written).To(BeEmpty())
+
+			dispatchUplink := func() {
+				lrscClient.dispatch(&lrscMessage{Type: messageTypeUpstream, DeviceGuid: "aa", Frequency: 868100000, DataRate: "SF9BW125"})
+			}
+			dispatchUplink()
+			dispatchUplink()
+			Expect(written).To(HaveLen(2))
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+			Expect(results).NotTo(Receive())
+
+			// the device refuses the session, the remaining frames are dropped
+			lrscClient.eventsFromUplink(lrscMessage{DeviceGuid: "aa", Port: defaultFragmentationPort, Payload: "0202"})
+			failed := <-results
+			Expect(failed.Status).To(Equal(bridge.CommandFailed))
+			Expect(failed.Reason).To(Equal("Device refused fragmentation session 0: not enough memory"))
+			Expect(lrscClient.downlinks.depth()).To(Equal(0))
+		})
+
+		It("waits for a free session when all of them are busy", func() {
+			for i := 0; i < maxFragmentSessions+1; i++ {
+				command.CorrelationId = strings.Repeat("c", i+1)
+				lrscClient.queueCommand(command)
+			}
+			for i := 0; i < maxFragmentSessions; i++ {
+				Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+				Expect((<-results).Status).To(Equal(bridge.CommandSent))
+			}
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+			Expect((<-results).Status).To(Equal(bridge.CommandDelayed))
+			Expect(lrscClient.downlinks.depth()).To(Equal(1))
+
+			lrscClient.eventsFromUplink(lrscMessage{DeviceGuid: "aa", Port: defaultFragmentationPort, Payload: "01030000" + "00"})
+			Expect((<-results).Status).To(Equal(bridge.CommandDelivered))
+
+			written = nil
+			lrscClient.releaseQueuedDownlinks()
+			Expect((<-results).Status).To(Equal(bridge.CommandSent))
+			Expect(written[0].Payload).To(HavePrefix("0200"))
+		})
+
+		It("times commands out whose fragments are not all sent in time", func() {
+			lrscClient.devices, _ = writeAndLoadDeviceConfig(`{
+				"devices": {"aa": "valve"},
+				"classes": {"classA": "uplink"},
+				"fragmentation": {"deviceTypes": ["valve"], "timeout": "1m"}
+			}`)
+			now := time.Now()
+			lrscClient.fragments.now = func() time.Time { return now }
+			lrscClient.inbound = make(chan lrscMessage, 10)
+			lrscClient.queueCommand(command)
+			lrscClient.dispatch(&lrscMessage{Type: messageTypeUpstream, DeviceGuid: "aa", Frequency: 868100000, DataRate: "SF10BW125"})
+			Expect(written).To(HaveLen(1))
+
+			now = now.Add(time.Minute)
+			lrscClient.expireFragments()
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+			timedOut := <-results
+			Expect(timedOut.Status).To(Equal(bridge.CommandTimedOut))
+			Expect(timedOut.Reason).To(Equal("fragments not sent in time"))
+			Expect(lrscClient.downlinks.depth()).To(Equal(0))
+			Expect(lrscClient.fragments.downlinks).To(BeEmpty())
+		})
+
+		It("resumes the sessions of commands fragmented before a restart", func() {
+			lrscClient.devices, _ = writeAndLoadDeviceConfig(`{
+				"devices": {"aa": "valve"},
+				"classes": {"classA": "uplink"},
+				"fragmentation": {"deviceTypes": ["valve"]}
+			}`)
+			dir, _ := ioutil.TempDir("", "downlinks")
+			path := filepath.Join(dir, "queue.json")
+			lrscClient.downlinks, _ = openDownlinkQueue(path)
+			lrscClient.inbound = make(chan lrscMessage, 10)
+			lrscClient.queueCommand(command)
+			lrscClient.dispatch(&lrscMessage{Type: messageTypeUpstream, DeviceGuid: "aa", Frequency: 868100000, DataRate: "SF10BW125"})
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+
+			lrscClient.downlinks, _ = openDownlinkQueue(path)
+			lrscClient.fragments = newFragmentSessions()
+			lrscClient.restoreFragments()
+			Expect(lrscClient.fragments.downlinks).To(HaveLen(1))
+
+			lrscClient.dispatch(&lrscMessage{Type: messageTypeUpstream, DeviceGuid: "aa", Frequency: 868100000, DataRate: "SF10BW125"})
+			Expect(written).To(HaveLen(2))
+			Expect(written[1].Payload).To(HavePrefix("080100"))
+
+			lrscClient.eventsFromUplink(lrscMessage{DeviceGuid: "aa", Port: defaultFragmentationPort, Payload: "01030000" + "00"})
+			Expect((<-results).Status).To(Equal(bridge.CommandDelivered))
+			Expect(lrscClient.fragments.downlinks).To(BeEmpty())
+		})
+
+		It("ends the session of a cancelled command", func() {
+			lrscClient.devices, _ = writeAndLoadDeviceConfig(`{
+				"devices": {"aa": "valve"},
+				"classes": {"classA": "uplink"},
+				"fragmentation": {"deviceTypes": ["valve"]}
+			}`)
+			lrscClient.inbound = make(chan lrscMessage, 10)
+			lrscClient.queueCommand(command)
+			lrscClient.dispatch(&lrscMessage{Type: messageTypeUpstream, DeviceGuid: "aa", Frequency: 868100000, DataRate: "SF10BW125"})
+			Expect(lrscClient.fragments.downlinks).To(HaveLen(1))
+
+			Expect(lrscClient.cancelCommand("c")).To(BeTrue())
+			Expect(lrscClient.fragments.downlinks).To(BeEmpty())
+		})
+
+		It("rejects commands whose fragments do not fit the device's data rate", func() {
+			lrscClient.devices, _ = writeAndLoadDeviceConfig(`{
+				"devices": {"aa": "valve"},
+				"fragmentation": {"deviceTypes": ["valve"], "fragmentSize": 60}
+			}`)
+			lrscClient.queueCommand(command)
+
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+			rejected := <-results
+			Expect(rejected.Status).To(Equal(bridge.CommandRejected))
+			Expect(rejected.Rejection.Length).To(Equal(63))
+			Expect(rejected.Rejection.MaxLength).To(Equal(51))
+			Expect(written).To(BeEmpty())
+			Expect(lrscClient.fragments.downlinks).To(BeEmpty())
+		})
+
+		It("rejects oversize commands for devices that do not fragment", func() {
+			command.Device = "bb"
+			lrscClient.queueCommand(command)
+
+			Expect((<-results).Status).To(Equal(bridge.CommandQueued))
+			Expect((<-results).Status).To(Equal(bridge.CommandRejected))
+			Expect(written).To(BeEmpty())
+		})
+
+		It("sends commands that fit as usual", func() {
+			lrscClient.pending = newPendingDownlinks(results)
+			command.Payload = "01"
+			lrscClient.queueCommand(command)
+
+			Expect(written).To(HaveLen(1))
+			Expect(written[0].Port).To(Equal(lrscDevicePort))
+			Expect(written[0].Payload).To(Equal("01"))
+			Expect(written[0].Mode).To(Equal(messageModeConfirmed))
+		})
+	})
+})
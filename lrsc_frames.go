@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/iotf"
+	"strings"
+	"sync"
+)
+
+const (
+	// a frame older than this many sequence numbers is taken as the
+	// first frame after a counter reset rather than a late one
+	maxReorderDistance = 16
+
+	// link events need this many expected frames before the loss means much
+	minFramesForLinkEvent = 10
+
+	linkEventName = "link"
+)
+
+// frameCounters follows the uplink sequence numbers of every device to
+// detect lost and reordered frames and counter resets
+type frameCounters struct {
+	lock          sync.Mutex
+	devices       map[string]*frameCounter
+	lossThreshold float64
+}
+
+type frameCounter struct {
+	last      uint64
+	received  uint64
+	lost      uint64
+	reordered uint64
+	resets    uint64
+	lossy     bool
+}
+
+type linkStatus struct {
+	Received       uint64  `json:"received"`
+	Lost           uint64  `json:"lost"`
+	Reordered      uint64  `json:"reordered"`
+	Resets         uint64  `json:"resets"`
+	LossPercentage float64 `json:"lossPercentage"`
+}
+
+// newFrameCounters creates the counters; a positive lossThreshold, in percent,
+// enables link events
+func newFrameCounters(lossThreshold float64) *frameCounters {
+	return &frameCounters{devices: make(map[string]*frameCounter), lossThreshold: lossThreshold}
+}
+
+// observe counts an uplink and returns a link event when the loss of its
+// device crosses the threshold, in either direction
+func (self *frameCounters) observe(message lrscMessage) *iotf.Event {
+	if self == nil {
+		return nil
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	device := strings.ToUpper(message.DeviceGuid)
+	seqno := message.UniqueSequenceNo
+
+	counter, known := self.devices[device]
+	if !known {
+		self.devices[device] = &frameCounter{last: seqno, received: 1}
+		return nil
+	}
+
+	switch {
+	case seqno == counter.last:
+		return nil
+	case seqno > counter.last:
+		if missing := seqno - counter.last - 1; missing > 0 {
+			logger.Debug("Lost %v uplinks from %v before %v", missing, device, seqno)
+			counter.lost += missing
+		}
+		counter.last = seqno
+	case counter.last-seqno <= maxReorderDistance:
+		logger.Debug("Uplink %v from %v arrived out of order", seqno, device)
+		counter.reordered++
+		if counter.lost > 0 {
+			counter.lost--
+		}
+	default:
+		logger.Info("Sequence number of %v went back from %v to %v, the device probably rejoined or rebooted", device, counter.last, seqno)
+		counter.resets++
+		counter.last = seqno
+	}
+	counter.received++
+
+	return self.checkLoss(message.DeviceGuid, counter)
+}
+
+func (self *frameCounters) checkLoss(device string, counter *frameCounter) *iotf.Event {
+	if self.lossThreshold <= 0 || counter.received+counter.lost < minFramesForLinkEvent {
+		return nil
+	}
+
+	lossy := counter.lossPercentage() >= self.lossThreshold
+	if lossy == counter.lossy {
+		return nil
+	}
+	counter.lossy = lossy
+
+	payload, _ := json.Marshal(counter.status())
+	return &iotf.Event{Device: device, Name: linkEventName, Payload: string(payload)}
+}
+
+func (self *frameCounter) lossPercentage() float64 {
+	expected := self.received + self.lost
+	if expected == 0 {
+		return 0
+	}
+	return float64(self.lost) * 100 / float64(expected)
+}
+
+func (self *frameCounter) status() linkStatus {
+	return linkStatus{
+		Received:       self.received,
+		Lost:           self.lost,
+		Reordered:      self.reordered,
+		Resets:         self.resets,
+		LossPercentage: self.lossPercentage(),
+	}
+}
+
+// statusByDevice returns the link status of every device seen
+func (self *frameCounters) statusByDevice() map[string]linkStatus {
+	statuses := make(map[string]linkStatus)
+	if self == nil {
+		return statuses
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for device, counter := range self.devices {
+		statuses[device] = counter.status()
+	}
+	return statuses
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/iotf"
+)
+
+var _ = Describe("Frame counters", func() {
+	var frames *frameCounters
+
+	receive := func(seqnos ...uint64) (events []iotf.Event) {
+		for _, seqno := range seqnos {
+			event := frames.observe(lrscMessage{DeviceGuid: "aa-00-00-00-00-00-00-01", UniqueSequenceNo: seqno})
+			if event != nil {
+				events = append(events, *event)
+			}
+		}
+		return events
+	}
+
+	status := func() linkStatus {
+		return frames.statusByDevice()["AA-00-00-00-00-00-00-01"]
+	}
+
+	BeforeEach(func() {
+		frames = newFrameCounters(0)
+	})
+
+	It("counts uplinks in order without loss", func() {
+		receive(5, 6, 7)
+		Expect(status()).To(Equal(linkStatus{Received: 3}))
+	})
+
+	It("counts the uplinks missing in gaps as lost", func() {
+		receive(1, 2, 5, 6)
+		Expect(status()).To(Equal(linkStatus{Received: 4, Lost: 2, LossPercentage: 100.0 / 3}))
+	})
+
+	It("takes late uplinks as reordered rather than lost", func() {
+		receive(1, 3, 2)
+		Expect(status()).To(Equal(linkStatus{Received: 3, Reordered: 1}))
+	})
+
+	It("detects counter resets", func() {
+		receive(100, 101, 0, 1)
+		Expect(status()).To(Equal(linkStatus{Received: 4, Resets: 1}))
+	})
+
+	It("ignores repeated sequence numbers", func() {
+		receive(1, 1, 2)
+		Expect(status().Received).To(BeEquivalentTo(2))
+	})
+
+	It("keeps devices apart", func() {
+		receive(1, 2)
+		frames.observe(lrscMessage{DeviceGuid: "BB-00-00-00-00-00-00-01", UniqueSequenceNo: 9})
+		Expect(frames.statusByDevice()).To(HaveLen(2))
+	})
+
+	Describe("link events", func() {
+		BeforeEach(func() {
+			frames = newFrameCounters(15)
+		})
+
+		It("are sent when the loss crosses the threshold", func() {
+			Expect(receive(1, 2, 3, 4, 5, 6, 7, 8)).To(BeEmpty())
+
+			events := receive(11)
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Device).To(Equal("aa-00-00-00-00-00-00-01"))
+			Expect(events[0].Name).To(Equal("link"))
+			Expect(events[0].Payload).To(MatchJSON(`{"received": 9, "lost": 2, "reordered": 0, "resets": 0, "lossPercentage": 18.181818181818183}`))
+		})
+
+		It("are not repeated while the loss stays above the threshold", func() {
+			receive(1, 5, 10, 15)
+			Expect(receive(20, 25)).To(BeEmpty())
+		})
+
+		It("are sent again when the loss drops below the threshold", func() {
+			receive(1, 2, 3, 4, 5, 6, 7, 8, 11)
+			Expect(receive(12, 13)).To(BeEmpty())
+			Expect(receive(14)).To(HaveLen(1))
+		})
+
+		It("need enough frames", func() {
+			Expect(receive(1, 5)).To(BeEmpty())
+		})
+	})
+
+	It("does nothing without counters", func() {
+		Expect((*frameCounters)(nil).observe(lrscMessage{})).To(BeNil())
+		Expect((*frameCounters)(nil).statusByDevice()).To(BeEmpty())
+	})
+})
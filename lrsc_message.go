@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 )
 
 type (
@@ -14,9 +16,15 @@ const (
 	messageModeUnconfirmed lrscMessageMode = 0
 	messageModeConfirmed   lrscMessageMode = 2
 
-	messageTypeHandshake  lrscMessageType = 0
-	messageTypeUpstream   lrscMessageType = 6
-	messageTypeDownstream lrscMessageType = 7
+	messageTypeHandshake      lrscMessageType = 0
+	messageTypeHello          lrscMessageType = 1
+	messageTypeError          lrscMessageType = 2
+	messageTypeJoin           lrscMessageType = 3
+	messageTypeGatewayStatus  lrscMessageType = 4
+	messageTypeUpstream       lrscMessageType = 6
+	messageTypeDownstream     lrscMessageType = 7
+	messageTypeDownstreamAck  lrscMessageType = 8
+	messageTypeDownstreamNack lrscMessageType = 9
 )
 
 type lrscMessage struct {
@@ -27,6 +35,109 @@ type lrscMessage struct {
 	Mode             lrscMessageMode `json:"mode"`
 	Timeout          uint            `json:"timeout"`
 	Port             uint            `json:"port"`
+
+	// radio metadata, only present on upstream messages
+	GatewayEui string  `json:"gweui,omitempty"`
+	Rssi       float64 `json:"rssi,omitempty"`
+	Snr        float64 `json:"snr,omitempty"`
+	Frequency  uint64  `json:"freq,omitempty"`
+	DataRate   string  `json:"dr,omitempty"`
+}
+
+type lrscHandshake struct {
+	Type      lrscMessageType `json:"msgtag"`
+	Eui       string          `json:"eui"`
+	EuiDomain int             `json:"euidom"`
+	Major     int             `json:"major"`
+	Minor     int             `json:"minor"`
+	Build     int             `json:"build"`
+	Name      string          `json:"name"`
+}
+
+type lrscError struct {
+	Type    lrscMessageType `json:"msgtag"`
+	Code    int             `json:"code"`
+	Message string          `json:"msg"`
+}
+
+type lrscJoin struct {
+	Type       lrscMessageType `json:"msgtag"`
+	DeviceGuid string          `json:"deveui"`
+	AppEui     string          `json:"appeui"`
+	DevAddr    string          `json:"devaddr"`
+}
+
+type lrscGatewayStatus struct {
+	Type       lrscMessageType `json:"msgtag"`
+	GatewayEui string          `json:"gweui"`
+	Connected  bool            `json:"connected"`
+}
+
+// lrscDownstreamResult acknowledges (msgtag 8) or rejects (msgtag 9) the
+// downstream message with the same seqno
+type lrscDownstreamResult struct {
+	Type             lrscMessageType `json:"msgtag"`
+	DeviceGuid       string          `json:"deveui"`
+	UniqueSequenceNo uint64          `json:"seqno"`
+	Reason           string          `json:"reason,omitempty"`
+}
+
+type unknownMessageTypeError struct {
+	Type lrscMessageType
+}
+
+func (self unknownMessageTypeError) Error() string {
+	return fmt.Sprintf("unknown LRSC msgtag %v", self.Type)
+}
+
+// decodeLrscMessage returns the typed message for the msgtag of s, one of
+// lrscHandshake, lrscError, lrscJoin, lrscGatewayStatus, lrscMessage or
+// lrscDownstreamResult
+func decodeLrscMessage(s string) (interface{}, error) {
+	var header struct {
+		Type *lrscMessageType `json:"msgtag"`
+	}
+
+	err := json.Unmarshal([]byte(s), &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Type == nil {
+		return nil, errors.New("LRSC message has no msgtag")
+	}
+
+	var message interface{}
+	switch *header.Type {
+	case messageTypeHandshake, messageTypeHello:
+		message = &lrscHandshake{}
+	case messageTypeError:
+		message = &lrscError{}
+	case messageTypeJoin:
+		message = &lrscJoin{}
+	case messageTypeGatewayStatus:
+		message = &lrscGatewayStatus{}
+	case messageTypeUpstream, messageTypeDownstream:
+		message = &lrscMessage{}
+	case messageTypeDownstreamAck, messageTypeDownstreamNack:
+		message = &lrscDownstreamResult{}
+	default:
+		return nil, unknownMessageTypeError{Type: *header.Type}
+	}
+
+	err = json.Unmarshal([]byte(s), message)
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+func parseLrscHandshake(s string) (lrscHandshake, error) {
+	var handshake lrscHandshake
+
+	err := json.Unmarshal([]byte(s), &handshake)
+
+	return handshake, err
 }
 
 func parseLrscMessage(s string) (lrscMessage, error) {
@@ -29,6 +29,75 @@ var _ = Describe("LrscMessage", func() {
 		It("downstream", func() {
 			Expect(messageTypeDownstream).To(Equal(lrscMessageType(7)))
 		})
+
+		It("downstream acknowledgement", func() {
+			Expect(messageTypeDownstreamAck).To(Equal(lrscMessageType(8)))
+		})
+
+		It("downstream rejection", func() {
+			Expect(messageTypeDownstreamNack).To(Equal(lrscMessageType(9)))
+		})
+	})
+
+	Describe("decoding", func() {
+		It("decodes uplinks", func() {
+			message, err := decodeLrscMessage(`{"msgtag":6,"deveui":"AA-AA","pdu":"test","seqno":3}`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(message).To(Equal(&lrscMessage{Type: messageTypeUpstream, DeviceGuid: "AA-AA", Payload: "test", UniqueSequenceNo: 3}))
+		})
+
+		It("decodes the radio metadata of uplinks", func() {
+			message, _ := decodeLrscMessage(`{"msgtag":6,"deveui":"AA-AA","pdu":"test","gweui":"GW","rssi":-97,"snr":7.5,"freq":868100000,"dr":"SF7BW125"}`)
+			uplink := message.(*lrscMessage)
+			Expect(uplink.GatewayEui).To(Equal("GW"))
+			Expect(uplink.Rssi).To(Equal(-97.0))
+			Expect(uplink.Snr).To(Equal(7.5))
+			Expect(uplink.Frequency).To(BeEquivalentTo(868100000))
+			Expect(uplink.DataRate).To(Equal("SF7BW125"))
+		})
+
+		It("decodes handshakes", func() {
+			message, _ := decodeLrscMessage(`{"msgtag":0,"eui":"00-00-00-00-00-00-00-01","major":1}`)
+			Expect(message).To(Equal(&lrscHandshake{Eui: "00-00-00-00-00-00-00-01", Major: 1}))
+		})
+
+		It("decodes errors", func() {
+			message, _ := decodeLrscMessage(`{"msgtag":2,"code":5,"msg":"bad"}`)
+			Expect(message).To(Equal(&lrscError{Type: messageTypeError, Code: 5, Message: "bad"}))
+		})
+
+		It("decodes joins", func() {
+			message, _ := decodeLrscMessage(`{"msgtag":3,"deveui":"AA-AA","appeui":"BB-BB","devaddr":"01020304"}`)
+			Expect(message).To(Equal(&lrscJoin{Type: messageTypeJoin, DeviceGuid: "AA-AA", AppEui: "BB-BB", DevAddr: "01020304"}))
+		})
+
+		It("decodes gateway status", func() {
+			message, _ := decodeLrscMessage(`{"msgtag":4,"gweui":"CC-CC","connected":true}`)
+			Expect(message).To(Equal(&lrscGatewayStatus{Type: messageTypeGatewayStatus, GatewayEui: "CC-CC", Connected: true}))
+		})
+
+		It("decodes downstream acknowledgements and rejections", func() {
+			ack, _ := decodeLrscMessage(`{"msgtag":8,"deveui":"AA-AA","seqno":12}`)
+			Expect(ack).To(Equal(&lrscDownstreamResult{Type: messageTypeDownstreamAck, DeviceGuid: "AA-AA", UniqueSequenceNo: 12}))
+
+			nack, _ := decodeLrscMessage(`{"msgtag":9,"deveui":"AA-AA","seqno":12,"reason":"expired"}`)
+			Expect(nack).To(Equal(&lrscDownstreamResult{Type: messageTypeDownstreamNack, DeviceGuid: "AA-AA", UniqueSequenceNo: 12, Reason: "expired"}))
+		})
+
+		It("returns an unknownMessageTypeError for unknown msgtags", func() {
+			_, err := decodeLrscMessage(`{"msgtag":99}`)
+			Expect(err).To(Equal(unknownMessageTypeError{Type: 99}))
+		})
+
+		It("fails without a msgtag", func() {
+			_, err := decodeLrscMessage(`{"deveui":"AA-AA"}`)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("fails on invalid JSON", func() {
+			_, err := decodeLrscMessage(`{"msgtag":`)
+			Expect(err).To(HaveOccurred())
+		})
 	})
 
 	Describe("encoding to json", func() {
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+)
+
+// payloadSizeError rejects a downlink too long for the data rate it would
+// be sent at
+type payloadSizeError struct {
+	DataRate  loraDataRate
+	Length    int
+	MaxLength int
+}
+
+func (self payloadSizeError) Error() string {
+	return fmt.Sprintf("Payload of %v bytes exceeds the maximum of %v bytes at %v", self.Length, self.MaxLength, self.DataRate)
+}
+
+func (self payloadSizeError) rejection() *bridge.CommandRejection {
+	return &bridge.CommandRejection{
+		Code:      bridge.RejectionPayloadTooLarge,
+		DataRate:  self.DataRate.String(),
+		Length:    self.Length,
+		MaxLength: self.MaxLength,
+	}
+}
+
+// payloadLimits holds downlinks to the most bytes the regional plan allows
+// at the data rate they are sent at
+type payloadLimits struct {
+	plan   *regionalPlan
+	radios *deviceRadios
+}
+
+// newPayloadLimits returns no limits for no plan or a plan without them
+func newPayloadLimits(plan *regionalPlan, radios *deviceRadios) *payloadLimits {
+	if plan == nil || plan.MaxPayload == nil {
+		return nil
+	}
+	return &payloadLimits{plan: plan, radios: radios}
+}
+
+// maxPayload returns the data rate of a downlink to a device, RX2's or else
+// that of the device's last uplink, and the most bytes it can carry. Data
+// rates missing from the plan are held to the limit of its default data
+// rate.
+func (self *payloadLimits) maxPayload(device string, rx2 bool) (loraDataRate, int) {
+	radio, heard := self.radios.radio(device)
+	dataRate := radio.dataRate
+	if !heard || rx2 {
+		dataRate = self.plan.DefaultDataRate
+	}
+
+	maxLength, known := self.plan.MaxPayload[dataRate]
+	if !known {
+		dataRate = self.plan.DefaultDataRate
+		maxLength = self.plan.MaxPayload[dataRate]
+	}
+	return dataRate, maxLength
+}
+
+// check tells whether a downlink of length bytes fits its data rate
+func (self *payloadLimits) check(device string, length int, rx2 bool) error {
+	if self == nil {
+		return nil
+	}
+
+	dataRate, maxLength := self.maxPayload(device, rx2)
+	if length > maxLength {
+		return payloadSizeError{DataRate: dataRate, Length: length, MaxLength: maxLength}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+)
+
+var _ = Describe("Payload size", func() {
+	var (
+		limits *payloadLimits
+		radios *deviceRadios
+	)
+
+	uplink := func(device, dataRate string) {
+		radios.observeUplink(lrscMessage{DeviceGuid: device, Frequency: 868100000, DataRate: dataRate})
+	}
+
+	BeforeEach(func() {
+		radios = newDeviceRadios()
+		limits = newPayloadLimits(eu868, radios)
+	})
+
+	It("limits downlinks by the data rate of the device's last uplink", func() {
+		uplink("aa", "SF9BW125")
+		Expect(limits.check("aa", 115, false)).To(Succeed())
+		Expect(limits.check("aa", 116, false)).To(Equal(payloadSizeError{
+			DataRate: loraDataRate{9, 125}, Length: 116, MaxLength: 115,
+		}))
+
+		uplink("AA", "SF7BW125")
+		Expect(limits.check("aa", 222, false)).To(Succeed())
+	})
+
+	It("uses the limit of RX2 for devices not heard yet", func() {
+		Expect(limits.check("aa", 51, false)).To(Succeed())
+		Expect(limits.check("aa", 52, false)).To(MatchError("Payload of 52 bytes exceeds the maximum of 51 bytes at SF12BW125"))
+	})
+
+	It("uses the limit of RX2 for downlinks sent in RX2", func() {
+		uplink("aa", "SF7BW125")
+		Expect(limits.check("aa", 52, true)).To(HaveOccurred())
+	})
+
+	It("uses the limit of RX2 for data rates outside the plan", func() {
+		uplink("aa", "SF8BW500")
+		Expect(limits.check("aa", 52, false)).To(HaveOccurred())
+	})
+
+	It("describes the rejection", func() {
+		err := payloadSizeError{DataRate: loraDataRate{12, 125}, Length: 60, MaxLength: 51}
+		Expect(err.rejection()).To(Equal(&bridge.CommandRejection{
+			Code: bridge.RejectionPayloadTooLarge, DataRate: "SF12BW125", Length: 60, MaxLength: 51,
+		}))
+	})
+
+	It("does not limit downlinks without a regional plan", func() {
+		limits = newPayloadLimits(nil, radios)
+		Expect(limits.check("aa", 1000, false)).To(Succeed())
+	})
+})
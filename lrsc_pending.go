@@ -0,0 +1,113 @@
+package main
+
+import (
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConfirmationTimeout uint = 60
+
+	// how long to wait beyond the LRSC timeout for LRSC's own verdict
+	confirmationGracePeriod = 5 * time.Second
+)
+
+// pendingDownlinks tracks confirmed downstream messages by seqno until LRSC
+// acknowledges or rejects them, or they time out. While held, their results
+// are kept back so that they follow the sent status of their commands.
+type pendingDownlinks struct {
+	lock    sync.Mutex
+	pending map[uint64]*pendingDownlink
+	results chan<- bridge.CommandResult
+	holding bool
+	held    []bridge.CommandResult
+}
+
+type pendingDownlink struct {
+	command bridge.Command
+	timer   *time.Timer
+}
+
+func newPendingDownlinks(results chan<- bridge.CommandResult) *pendingDownlinks {
+	return &pendingDownlinks{pending: make(map[uint64]*pendingDownlink), results: results}
+}
+
+func (self *pendingDownlinks) add(seqno uint64, command bridge.Command, timeout time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.pending[seqno] = &pendingDownlink{
+		command: command,
+		timer: time.AfterFunc(timeout, func() {
+			self.complete(seqno, bridge.CommandTimedOut, "no acknowledgement received")
+		}),
+	}
+}
+
+func (self *pendingDownlinks) remove(seqno uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if downlink, present := self.pending[seqno]; present {
+		downlink.timer.Stop()
+		delete(self.pending, seqno)
+	}
+}
+
+// hold keeps results back until release
+func (self *pendingDownlinks) hold() {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.holding = true
+}
+
+// release publishes the results kept back since hold
+func (self *pendingDownlinks) release() {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	held := self.held
+	self.holding, self.held = false, nil
+	self.lock.Unlock()
+
+	for _, result := range held {
+		self.results <- result
+	}
+}
+
+func (self *pendingDownlinks) resolve(result *lrscDownstreamResult) {
+	if result.Type == messageTypeDownstreamAck {
+		self.complete(result.UniqueSequenceNo, bridge.CommandDelivered, "")
+	} else {
+		self.complete(result.UniqueSequenceNo, bridge.CommandFailed, result.Reason)
+	}
+}
+
+func (self *pendingDownlinks) complete(seqno uint64, status bridge.CommandStatus, reason string) {
+	self.lock.Lock()
+	downlink, present := self.pending[seqno]
+	var result bridge.CommandResult
+	held := false
+	if present {
+		downlink.timer.Stop()
+		delete(self.pending, seqno)
+		result = bridge.CommandResult{Command: downlink.command, Status: status, Reason: reason}
+		if held = self.holding; held {
+			self.held = append(self.held, result)
+		}
+	}
+	self.lock.Unlock()
+
+	if !present {
+		logger.Warning("Received %v for unknown downstream message %v", status, seqno)
+		return
+	}
+	if !held {
+		self.results <- result
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"time"
+)
+
+var _ = Describe("Pending downlinks", func() {
+	var (
+		results chan bridge.CommandResult
+		pending *pendingDownlinks
+		command bridge.Command
+	)
+
+	BeforeEach(func() {
+		results = make(chan bridge.CommandResult, 10)
+		pending = newPendingDownlinks(results)
+		command = bridge.Command{Device: "dev", Payload: "0102", Confirmed: true}
+		pending.add(7, command, time.Minute)
+	})
+
+	It("reports acknowledged downlinks as delivered", func() {
+		pending.resolve(&lrscDownstreamResult{Type: messageTypeDownstreamAck, UniqueSequenceNo: 7})
+		Expect(<-results).To(Equal(bridge.CommandResult{Command: command, Status: bridge.CommandDelivered}))
+	})
+
+	It("reports rejected downlinks as failed", func() {
+		pending.resolve(&lrscDownstreamResult{Type: messageTypeDownstreamNack, UniqueSequenceNo: 7, Reason: "expired"})
+		Expect(<-results).To(Equal(bridge.CommandResult{Command: command, Status: bridge.CommandFailed, Reason: "expired"}))
+	})
+
+	It("reports downlinks without an answer as timed out", func() {
+		pending.add(8, command, time.Millisecond)
+
+		var result bridge.CommandResult
+		Eventually(results).Should(Receive(&result))
+		Expect(result.Status).To(Equal(bridge.CommandTimedOut))
+	})
+
+	It("only reports each downlink once", func() {
+		pending.resolve(&lrscDownstreamResult{Type: messageTypeDownstreamAck, UniqueSequenceNo: 7})
+		pending.resolve(&lrscDownstreamResult{Type: messageTypeDownstreamNack, UniqueSequenceNo: 7})
+		Expect(results).To(HaveLen(1))
+	})
+
+	It("keeps results back while held", func() {
+		pending.hold()
+		pending.resolve(&lrscDownstreamResult{Type: messageTypeDownstreamAck, UniqueSequenceNo: 7})
+		Expect(results).To(BeEmpty())
+
+		pending.release()
+		Expect((<-results).Status).To(Equal(bridge.CommandDelivered))
+
+		pending.add(8, command, time.Minute)
+		pending.resolve(&lrscDownstreamResult{Type: messageTypeDownstreamAck, UniqueSequenceNo: 8})
+		Expect(results).To(HaveLen(1))
+	})
+
+	It("ignores results for unknown seqnos", func() {
+		pending.resolve(&lrscDownstreamResult{Type: messageTypeDownstreamAck, UniqueSequenceNo: 99})
+		Expect(results).To(BeEmpty())
+	})
+
+	It("forgets removed downlinks", func() {
+		pending.remove(7)
+		pending.resolve(&lrscDownstreamResult{Type: messageTypeDownstreamAck, UniqueSequenceNo: 7})
+		Expect(results).To(BeEmpty())
+	})
+})
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long the gateway and radio settings of a device's last uplink are used
+// for its downlinks
+const radioMemory = 24 * time.Hour
+
+// deviceRadios remembers how every device was last heard, which is how the
+// downlinks sent right after its uplinks go out
+type deviceRadios struct {
+	lock   sync.Mutex
+	radios map[string]deviceRadio
+	now    func() time.Time
+}
+
+type deviceRadio struct {
+	dataRate  loraDataRate
+	frequency uint64
+	gateway   string
+	heard     time.Time
+}
+
+func newDeviceRadios() *deviceRadios {
+	return &deviceRadios{radios: make(map[string]deviceRadio), now: time.Now}
+}
+
+// observeUplink remembers how the downlinks to a device will be sent
+func (self *deviceRadios) observeUplink(message lrscMessage) {
+	if self == nil {
+		return
+	}
+
+	dataRate, err := parseDataRate(message.DataRate)
+	if err != nil {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.radios[strings.ToUpper(message.DeviceGuid)] = deviceRadio{dataRate: dataRate, frequency: message.Frequency, gateway: message.GatewayEui, heard: self.now()}
+}
+
+// radio returns how a device was last heard, if it was
+func (self *deviceRadios) radio(device string) (deviceRadio, bool) {
+	if self == nil {
+		return deviceRadio{}, false
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	radio, heard := self.radios[strings.ToUpper(device)]
+	return radio, heard
+}
+
+// prune forgets the devices not heard for radioMemory
+func (self *deviceRadios) prune() {
+	if self == nil {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.now()
+	for device, radio := range self.radios {
+		if now.Sub(radio.heard) >= radioMemory {
+			delete(self.radios, device)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Device radios", func() {
+	var (
+		radios *deviceRadios
+		now    time.Time
+	)
+
+	BeforeEach(func() {
+		now = time.Now()
+		radios = newDeviceRadios()
+		radios.now = func() time.Time { return now }
+	})
+
+	It("remembers how devices were last heard", func() {
+		radios.observeUplink(lrscMessage{DeviceGuid: "aa", GatewayEui: "GW", Frequency: 868100000, DataRate: "SF9BW125"})
+		radios.observeUplink(lrscMessage{DeviceGuid: "bb", DataRate: "garbled"})
+
+		radio, heard := radios.radio("AA")
+		Expect(heard).To(BeTrue())
+		Expect(radio.dataRate).To(Equal(loraDataRate{9, 125}))
+		Expect(radio.frequency).To(BeEquivalentTo(868100000))
+		Expect(radio.gateway).To(Equal("GW"))
+
+		_, heard = radios.radio("bb")
+		Expect(heard).To(BeFalse())
+	})
+
+	It("forgets devices not heard for long", func() {
+		radios.observeUplink(lrscMessage{DeviceGuid: "aa", DataRate: "SF9BW125"})
+
+		now = now.Add(radioMemory - time.Second)
+		radios.prune()
+		_, heard := radios.radio("aa")
+		Expect(heard).To(BeTrue())
+
+		now = now.Add(time.Second)
+		radios.prune()
+		_, heard = radios.radio("aa")
+		Expect(heard).To(BeFalse())
+	})
+})
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+)
+
+// bufferResults returns a channel whose command results are passed on to
+// results in order. Sending on it does not block while results is full, the
+// results wait in memory instead, so a slow reader of the results cannot
+// stall the LRSC connection or the commands queued for it.
+func bufferResults(results chan<- bridge.CommandResult) chan<- bridge.CommandResult {
+	buffered := make(chan bridge.CommandResult)
+
+	go func() {
+		var waiting []bridge.CommandResult
+		in := (<-chan bridge.CommandResult)(buffered)
+		for in != nil || len(waiting) > 0 {
+			var out chan<- bridge.CommandResult
+			var next bridge.CommandResult
+			if len(waiting) > 0 {
+				out, next = results, waiting[0]
+			}
+
+			select {
+			case result, open := <-in:
+				if !open {
+					in = nil
+					continue
+				}
+				waiting = append(waiting, result)
+			case out <- next:
+				waiting = waiting[1:]
+			}
+		}
+	}()
+
+	return buffered
+}
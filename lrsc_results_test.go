@@ -0,0 +1,50 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"strconv"
+)
+
+var _ = Describe("Buffered results", func() {
+	var (
+		results  chan bridge.CommandResult
+		buffered chan<- bridge.CommandResult
+	)
+
+	BeforeEach(func() {
+		results = make(chan bridge.CommandResult)
+		buffered = bufferResults(results)
+	})
+
+	AfterEach(func() {
+		close(buffered)
+	})
+
+	result := func(n int) bridge.CommandResult {
+		return bridge.CommandResult{Command: bridge.Command{CorrelationId: strconv.Itoa(n)}, Status: bridge.CommandSent}
+	}
+
+	It("does not block while nobody reads the results", func() {
+		sent := make(chan struct{})
+		go func() {
+			for n := 0; n < 200; n++ {
+				buffered <- result(n)
+			}
+			close(sent)
+		}()
+
+		Eventually(sent).Should(BeClosed())
+	})
+
+	It("passes the results on in order", func() {
+		for n := 0; n < 200; n++ {
+			buffered <- result(n)
+		}
+
+		for n := 0; n < 200; n++ {
+			Expect(<-results).To(Equal(result(n)))
+		}
+	})
+})
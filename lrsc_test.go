@@ -1,21 +1,102 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/deadletter"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/iotf"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
 	"io"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"time"
 )
 
 var _ = Describe("LRSC Bridge", func() {
-	It("validates handshake", func() {
+	Describe("validating the handshake", func() {
+		var reply lrscHandshake
 
-		RegisterTestingT(GinkgoT())
+		BeforeEach(func() {
+			reply, _ = parseLrscHandshake(testHandshake)
+		})
+
+		It("accepts a well formed reply", func() {
+			Expect(validateHandshake(reply, "")).To(Succeed())
+		})
+
+		It("rejects a reply with the wrong msgtag", func() {
+			reply.Type = messageTypeUpstream
+			Expect(validateHandshake(reply, "")).ToNot(Succeed())
+		})
+
+		It("rejects an unsupported major version", func() {
+			reply.Major = 2
+			Expect(validateHandshake(reply, "")).ToNot(Succeed())
+		})
 
-		response := "some_handshake_response\n"
-		Expect(validateHandshake(response)).To(Equal(true))
+		It("rejects a malformed EUI", func() {
+			reply.Eui = "not-an-eui"
+			Expect(validateHandshake(reply, "")).ToNot(Succeed())
+		})
+
+		It("checks the EUI when one is expected", func() {
+			Expect(validateHandshake(reply, "00-00-00-00-00-00-00-01")).To(Succeed())
+			Expect(validateHandshake(reply, "00-00-00-00-00-00-00-02")).ToNot(Succeed())
+		})
+	})
+
+	Describe("negotiating the version", func() {
+		It("uses the server's minor version when it is older", func() {
+			Expect(negotiateVersion(lrscHandshake{Major: 1, Minor: 1}, 2)).To(Equal("1.1"))
+		})
+
+		It("uses our own minor version when the server is newer", func() {
+			Expect(negotiateVersion(lrscHandshake{Major: 1, Minor: 3}, 2)).To(Equal("1.2"))
+			Expect(negotiateVersion(lrscHandshake{Major: 1, Minor: 3}, lrscProtocolMinor)).To(Equal("1.0"))
+		})
+	})
+
+	Describe("handshake", func() {
+		establishWithReply := func(reply string) (*lrscConnection, error) {
+			mockConn := &mockConnection{
+				readFunc: func() (string, error) {
+					return reply + "\n", nil
+				},
+				writeFunc: func(string) error {
+					return nil
+				},
+			}
+			lrscClient := &lrscConnection{dialer: &testDialer{conn: mockConn}}
+			lrscClient.StatusReporter = reporter.New()
+			return lrscClient, lrscClient.establish()
+		}
+
+		It("reports the negotiated version", func() {
+			lrscClient, err := establishWithReply(testHandshake)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lrscClient.Summary()).To(MatchJSON(`{"CONNECTION":"OK","VERSION":"1.0"}`))
+		})
+
+		It("fails the connection attempt on an invalid reply", func() {
+			lrscClient, err := establishWithReply(`{"msgtag":0,"eui":"00-00-00-00-00-00-00-01","major":2}`)
+			Expect(err).To(MatchError(ContainSubstring("protocol version 2.0")))
+			Expect(lrscClient.Summary()).To(ContainSubstring("protocol version 2.0"))
+		})
+
+		It("fails the connection attempt on an unparsable reply", func() {
+			_, err := establishWithReply("garbage")
+			Expect(err).To(HaveOccurred())
+		})
 	})
 
 	It("reconnects", func() {
@@ -24,11 +105,14 @@ var _ = Describe("LRSC Bridge", func() {
 
 		mockConn := &mockConnection{
 			readFunc: func() (string, error) {
-				if count == 0 {
-					count += 1
+				count += 1
+				switch count {
+				case 1:
 					return "", errors.New("EOF")
-				} else {
-					return "{}\n", nil
+				case 2:
+					return testHandshake + "\n", nil
+				default:
+					return testUplink + "\n", nil
 				}
 			},
 			writeFunc: func(message string) error {
@@ -51,9 +135,7 @@ var _ = Describe("LRSC Bridge", func() {
 
 	It("can receive a message", func() {
 		mockConn := &mockConnection{
-			readFunc: func() (string, error) {
-				return `{"deveui": "id", "pdu": "data"}` + "\n", nil
-			},
+			readFunc: scriptedReads(testHandshake, `{"msgtag": 6, "deveui": "id", "pdu": "data"}`),
 			writeFunc: func(string) error {
 				return nil
 			},
@@ -66,7 +148,82 @@ var _ = Describe("LRSC Bridge", func() {
 		go runConnectionLoop("LRSC Client", lrscClient)
 
 		messages := lrscClient.inbound
-		Expect(<-messages).To(Equal(lrscMessage{DeviceGuid: "id", Payload: "data"}))
+		Expect(<-messages).To(Equal(lrscMessage{Type: messageTypeUpstream, DeviceGuid: "id", Payload: "data"}))
+	})
+
+	Describe("dispatching received messages", func() {
+		var lrscClient *lrscConnection
+
+		receive := func(lines ...string) {
+			mockConn := &mockConnection{
+				readFunc:  scriptedReads(append([]string{testHandshake}, lines...)...),
+				writeFunc: func(string) error { return nil },
+			}
+			lrscClient = &lrscConnection{dialer: &testDialer{conn: mockConn}}
+			lrscClient.StatusReporter = reporter.New()
+			lrscClient.inbound = make(chan lrscMessage)
+			lrscClient.err = make(chan error)
+			lrscClient.pending = newPendingDownlinks(make(chan bridge.CommandResult, 10))
+			lrscClient.dedup = newUplinkDeduplicator(time.Minute)
+			lrscClient.deadLetters, _ = deadletter.Open("", 10)
+			lrscClient.establish()
+			go lrscClient.Loop()
+		}
+
+		It("only forwards uplinks", func() {
+			receive(
+				`{"msgtag":3,"deveui":"joined","devaddr":"01020304"}`,
+				`{"msgtag":4,"gweui":"00-00-00-00-00-00-00-02","connected":true}`,
+				`{"msgtag":8,"deveui":"id","seqno":1}`,
+				`{"msgtag":7,"deveui":"down","pdu":"data"}`,
+				testUplink,
+			)
+
+			Expect((<-lrscClient.inbound).DeviceGuid).To(Equal("id"))
+		})
+
+		It("reports gateway status", func() {
+			receive(`{"msgtag":4,"gweui":"00-00-00-00-00-00-00-02","connected":true}`, testUplink)
+			<-lrscClient.inbound
+
+			Expect(lrscClient.Summary()).To(ContainSubstring(`"GATEWAY 00-00-00-00-00-00-00-02":"CONNECTED"`))
+		})
+
+		It("reports errors sent by LRSC", func() {
+			receive(`{"msgtag":2,"code":17,"msg":"unknown device"}`, testUplink)
+			<-lrscClient.inbound
+
+			Expect(lrscClient.Summary()).To(ContainSubstring(`"LAST_ERROR":"17: unknown device"`))
+		})
+
+		It("drops and counts duplicate uplinks", func() {
+			receive(testUplink, testUplink, `{"msgtag":6,"deveui":"id","pdu":"data","seqno":2}`)
+
+			Expect((<-lrscClient.inbound).UniqueSequenceNo).To(BeEquivalentTo(1))
+			Expect((<-lrscClient.inbound).UniqueSequenceNo).To(BeEquivalentTo(2))
+			Expect(lrscClient.Summary()).To(ContainSubstring(`"DUPLICATES":"1"`))
+			Expect(lrscClient.deviceStats()["ID"].Duplicates).To(BeEquivalentTo(1))
+		})
+
+		It("counts and skips unknown msgtags", func() {
+			receive(`{"msgtag":42,"deveui":"id","pdu":"data"}`, `{"msgtag":43}`, testUplink)
+			<-lrscClient.inbound
+
+			Expect(lrscClient.Summary()).To(ContainSubstring(`"UNKNOWN_MESSAGES":"2"`))
+		})
+
+		It("quarantines malformed messages and keeps reading", func() {
+			receive(`{"msgtag":6,`, `{"deveui":"id"}`, testUplink)
+
+			Expect((<-lrscClient.inbound).DeviceGuid).To(Equal("id"))
+			Expect(lrscClient.Error()).NotTo(Receive())
+			Expect(lrscClient.Summary()).To(ContainSubstring(`"MALFORMED_MESSAGES":"2"`))
+
+			letters := lrscClient.deadLetters.(*deadletter.Queue).List(bridge.StageLrscParse)
+			Expect(letters).To(HaveLen(2))
+			Expect(letters[0].Payload).To(Equal(`{"msgtag":6,`))
+			Expect(letters[1].Error).To(Equal("LRSC message has no msgtag"))
+		})
 	})
 	It("reports an error if connection fails", func() {
 		failingDialer := &failingDialer{}
@@ -88,8 +245,8 @@ var _ = Describe("LRSC Bridge", func() {
 				return nil
 			},
 		}
-		lrscClient := lrscConnection{conn: mockConn}
-		lrscClient.sendCommand(bridge.Command{Device: "device", Payload: "payload"})
+		lrscClient := lrscConnection{conn: newLineTransport(mockConn)}
+		lrscClient.sendCommand(bridge.Command{Device: "device", Payload: "01ab"})
 
 		message, err := parseLrscMessage(written)
 		if err != nil {
@@ -97,13 +254,109 @@ var _ = Describe("LRSC Bridge", func() {
 		}
 
 		Expect(message.DeviceGuid).To(Equal("device"))
-		Expect(message.Payload).To(Equal("payload"))
+		Expect(message.Payload).To(Equal("01ab"))
 		Expect(message.Type).To(Equal(messageTypeDownstream))
 		Expect(message.UniqueSequenceNo).To(BeEquivalentTo(1))
 		Expect(message.Port).To(BeEquivalentTo(10))
 		Expect(message.Mode).To(Equal(messageModeUnconfirmed))
 	})
 
+	It("writes commands to the port configured for them", func() {
+		written := ""
+		mockConn := &mockConnection{
+			writeFunc: func(s string) error {
+				written = s
+				return nil
+			},
+		}
+		devices := &deviceConfig{CommandPorts: commandPorts{portMapping: portMapping{Commands: map[string]uint{"config": 3}}}}
+		lrscClient := lrscConnection{conn: newLineTransport(mockConn), devices: devices}
+		lrscClient.sendCommand(bridge.Command{Device: "device", Name: "config", Payload: "01ab"})
+
+		message, _ := parseLrscMessage(written)
+		Expect(message.Port).To(BeEquivalentTo(3))
+	})
+
+	Describe("encoding commands", func() {
+		var (
+			written    string
+			lrscClient lrscConnection
+		)
+
+		BeforeEach(func() {
+			written = ""
+			mockConn := &mockConnection{
+				writeFunc: func(s string) error {
+					written = s
+					return nil
+				},
+			}
+			devices, _ := writeAndLoadDeviceConfig(`{"codecs": {"ports": {"10": "json"}}}`)
+			lrscClient = lrscConnection{conn: newLineTransport(mockConn), StatusReporter: reporter.New(), devices: devices}
+		})
+
+		It("encodes the payload with the codec of the command", func() {
+			err := lrscClient.sendCommand(bridge.Command{Device: "device", Payload: `{"on": true}`})
+			Expect(err).ToNot(HaveOccurred())
+
+			message, _ := parseLrscMessage(written)
+			Expect(message.Payload).To(Equal(hex.EncodeToString([]byte(`{"on":true}`))))
+		})
+
+		It("does not send commands that cannot be encoded", func() {
+			err := lrscClient.sendCommand(bridge.Command{Device: "device", Payload: "on"})
+			Expect(err).To(MatchError("Could not encode command: command is not valid JSON"))
+			Expect(written).To(BeEmpty())
+			Expect(lrscClient.Summary()).To(ContainSubstring(`"ENCODE_ERROR":"device: command is not valid JSON"`))
+		})
+	})
+
+	Describe("confirmed commands", func() {
+		var (
+			written    string
+			results    chan bridge.CommandResult
+			lrscClient lrscConnection
+		)
+
+		BeforeEach(func() {
+			mockConn := &mockConnection{
+				readFunc: func() (string, error) {
+					return "", nil
+				},
+				writeFunc: func(s string) error {
+					written = s
+					return nil
+				},
+			}
+			results = make(chan bridge.CommandResult, 10)
+			lrscClient = lrscConnection{conn: newLineTransport(mockConn), pending: newPendingDownlinks(results)}
+		})
+
+		It("asks LRSC for confirmation", func() {
+			lrscClient.sendCommand(bridge.Command{Device: "device", Confirmed: true, Timeout: 30})
+
+			message, _ := parseLrscMessage(written)
+			Expect(message.Mode).To(Equal(messageModeConfirmed))
+			Expect(message.Timeout).To(BeEquivalentTo(30))
+		})
+
+		It("uses a default timeout", func() {
+			lrscClient.sendCommand(bridge.Command{Device: "device", Confirmed: true})
+
+			message, _ := parseLrscMessage(written)
+			Expect(message.Timeout).To(Equal(defaultConfirmationTimeout))
+		})
+
+		It("matches the acknowledgement to the command", func() {
+			command := bridge.Command{Device: "device", Payload: "0102", Confirmed: true}
+			lrscClient.sendCommand(command)
+			message, _ := parseLrscMessage(written)
+
+			lrscClient.dispatch(&lrscDownstreamResult{Type: messageTypeDownstreamAck, DeviceGuid: "device", UniqueSequenceNo: message.UniqueSequenceNo})
+			Expect(<-results).To(Equal(bridge.CommandResult{Command: command, Status: bridge.CommandDelivered}))
+		})
+	})
+
 	It("increases sequence number", func() {
 		written := ""
 		mockConn := &mockConnection{
@@ -115,7 +368,7 @@ var _ = Describe("LRSC Bridge", func() {
 				return nil
 			},
 		}
-		lrscClient := lrscConnection{conn: mockConn}
+		lrscClient := lrscConnection{conn: newLineTransport(mockConn)}
 
 		for i := 1; i <= 5; i++ {
 			lrscClient.sendCommand(bridge.Command{})
@@ -129,6 +382,52 @@ var _ = Describe("LRSC Bridge", func() {
 		}
 	})
 
+	Describe("converting LRSC upstream messages to events", func() {
+		It("uses the device and payload", func() {
+			event := convertLrscUpstreamMessageToEvent(lrscMessage{DeviceGuid: "AA-AA", Payload: "payload"})
+			Expect(event).To(Equal(iotf.Event{Device: "AA-AA", Payload: "payload"}))
+		})
+
+		It("carries the radio metadata", func() {
+			event := convertLrscUpstreamMessageToEvent(lrscMessage{
+				DeviceGuid: "AA-AA", Payload: "payload", Port: 5, UniqueSequenceNo: 9,
+				GatewayEui: "GW", Rssi: -110, Snr: -2.5, Frequency: 868300000, DataRate: "SF12BW125",
+			})
+
+			Expect(event.Radio).To(Equal(&iotf.RadioMetadata{
+				Gateway: "GW", Rssi: -110, Snr: -2.5, Frequency: 868300000, DataRate: "SF12BW125", Port: 5, SequenceNumber: 9,
+			}))
+		})
+	})
+
+	Describe("creating events from uplinks", func() {
+		var lrscClient lrscConnection
+
+		BeforeEach(func() {
+			devices, _ := writeAndLoadDeviceConfig(`{"codecs": {"ports": {"2": "json"}}, "events": [{"field": "alarm", "name": "alarm"}]}`)
+			lrscClient = lrscConnection{StatusReporter: reporter.New(), devices: devices}
+		})
+
+		It("decodes the payload with the codec of the uplink", func() {
+			event := lrscClient.eventFromUplink(lrscMessage{DeviceGuid: "AA-AA", Payload: "01ab", Port: 1})
+			Expect(event.Payload).To(MatchJSON(`{"payload":"01ab"}`))
+			Expect(event.Name).To(Equal("1"))
+		})
+
+		It("names the event after the decoded payload", func() {
+			pdu := hex.EncodeToString([]byte(`{"alarm":1}`))
+			event := lrscClient.eventFromUplink(lrscMessage{DeviceGuid: "AA-AA", Payload: pdu, Port: 2})
+			Expect(event.Payload).To(MatchJSON(`{"alarm":1}`))
+			Expect(event.Name).To(Equal("alarm"))
+		})
+
+		It("publishes the raw PDU and reports uplinks that cannot be decoded", func() {
+			event := lrscClient.eventFromUplink(lrscMessage{DeviceGuid: "AA-AA", Payload: "01ab", Port: 2})
+			Expect(event.Payload).To(MatchJSON(`{"payload":"01ab"}`))
+			Expect(lrscClient.Summary()).To(ContainSubstring(`"DECODE_ERROR":"AA-AA: payload is not valid JSON"`))
+		})
+	})
+
 	Describe("converting commands to LRSC downstream messages", func() {
 		lrscMessage := convertCommandToLrscDownstreamMessage(bridge.Command{Device: "AA-AA", Payload: "payload"})
 
@@ -146,12 +445,27 @@ var _ = Describe("LRSC Bridge", func() {
 	})
 })
 
+const testHandshake = `{"msgtag":0,"eui":"00-00-00-00-00-00-00-01","euidom":0,"major":1,"minor":0,"build":0,"name":"LRSC"}`
+
+const testUplink = `{"msgtag":6,"deveui":"id","pdu":"data","seqno":1}`
+
+// scriptedReads returns each line in turn, repeating the last one forever
+func scriptedReads(lines ...string) func() (string, error) {
+	return func() (string, error) {
+		line := lines[0]
+		if len(lines) > 1 {
+			lines = lines[1:]
+		}
+		return line + "\n", nil
+	}
+}
+
 type testDialer struct {
 	conn io.ReadWriteCloser
 }
 
-func (self testDialer) dial() (io.ReadWriteCloser, error) {
-	return self.conn, nil
+func (self testDialer) dial() (transport, error) {
+	return newLineTransport(self.conn), nil
 }
 
 func (self testDialer) endpoint() string {
@@ -161,7 +475,7 @@ func (self testDialer) endpoint() string {
 type failingDialer struct {
 }
 
-func (self failingDialer) dial() (io.ReadWriteCloser, error) {
+func (self failingDialer) dial() (transport, error) {
 	return nil, errors.New("FAILED")
 }
 
@@ -189,3 +503,26 @@ func (self *mockConnection) Write(b []byte) (n int, err error) {
 func (self *mockConnection) Close() error {
 	return nil
 }
+
+func writeTestCertificate() (certFile, keyFile string) {
+	dir, _ := ioutil.TempDir("", "lrsc-certs")
+	certFile = filepath.Join(dir, "client.cert")
+	keyFile = filepath.Join(dir, "client.key")
+	writeTestCertificateFiles(certFile, keyFile, time.Now().Add(time.Hour))
+	return certFile, keyFile
+}
+
+func writeTestCertificateFiles(certFile, keyFile string, notAfter time.Time) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "FF-00-00-00-00-00-00-00"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/keystore"
+	"io/ioutil"
+	"strings"
+)
+
+type tlsDialer struct {
+	raddr       string
+	credentials *tlsCredentials
+	pins        []string
+}
+
+type dialerConfig struct {
+	host, port, cert, key string
+	transport, path       string
+	ca                    string
+	pins                  []string
+
+	archive, eui, keystorePassword string
+}
+
+func (self *tlsDialer) dial() (transport, error) {
+	conn, err := dialTls(self.raddr, self.credentials.context(), self.pins)
+	if err != nil {
+		return nil, err
+	}
+	return newLineTransport(conn), nil
+}
+
+func (self *tlsDialer) endpoint() string {
+	return self.raddr
+}
+
+func createTlsDialer(config dialerConfig, credentials *tlsCredentials) dialer {
+	endpoint := fmt.Sprintf("%v:%v", config.host, config.port)
+	return &tlsDialer{raddr: endpoint, credentials: credentials, pins: config.pins}
+}
+
+func createTlsContext(config dialerConfig) (*tls.Config, error) {
+	cert, key, ca, err := loadCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+
+	context := &tls.Config{ServerName: config.host}
+	certificate, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	context.Certificates = []tls.Certificate{certificate}
+
+	if ca != nil {
+		context.RootCAs = x509.NewCertPool()
+		if !context.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("Could not parse CA certificate")
+		}
+	}
+
+	return context, nil
+}
+
+// loadCredentials reads the PEM encoded client certificate, client key and
+// CA certificate, either from the LRSC key archive or from individual files.
+// The CA file is only used when the archive does not contain a CA.
+func loadCredentials(config dialerConfig) (cert, key, ca []byte, err error) {
+	if config.archive != "" {
+		credentials, err := keystore.Load(config.archive, config.eui, config.keystorePassword)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		logger.Info("Loaded LRSC credentials for %v from %v", credentials.Eui, config.archive)
+		cert, key, ca = credentials.Certificate, credentials.Key, credentials.CA
+	} else {
+		cert, err = ioutil.ReadFile(config.cert)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Could not read client certificate: %v", err)
+		}
+
+		key, err = ioutil.ReadFile(config.key)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Could not read client key: %v", err)
+		}
+	}
+
+	if ca == nil && config.ca != "" {
+		ca, err = ioutil.ReadFile(config.ca)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Could not read CA certificate: %v", err)
+		}
+	}
+
+	return cert, key, ca, nil
+}
+
+// dialTls opens a verified TLS connection and, when pins are configured,
+// checks that the server's chain contains one of the pinned public keys
+func dialTls(raddr string, context *tls.Config, pins []string) (*tls.Conn, error) {
+	conn, err := tls.Dial("tcp", raddr, context)
+	if err != nil {
+		return nil, describeDialError(err)
+	}
+
+	err = verifyPins(conn.ConnectionState(), pins)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func describeDialError(err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return fmt.Errorf("LRSC server certificate verification failed: %v", err)
+	}
+	return err
+}
+
+func verifyPins(state tls.ConnectionState, pins []string) error {
+	if len(pins) == 0 {
+		return nil
+	}
+
+	for _, chain := range state.VerifiedChains {
+		for _, certificate := range chain {
+			fingerprint := spkiFingerprint(certificate)
+			for _, pin := range pins {
+				if pin == fingerprint {
+					return nil
+				}
+			}
+		}
+	}
+
+	return errors.New("LRSC server certificate verification failed: no certificate in the chain matches a pinned public key")
+}
+
+func spkiFingerprint(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func parsePins(pins string) []string {
+	parsed := []string{}
+	for _, pin := range strings.Split(pins, ",") {
+		pin = strings.TrimSpace(pin)
+		if pin != "" {
+			parsed = append(parsed, pin)
+		}
+	}
+	return parsed
+}
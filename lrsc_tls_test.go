@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("LRSC TLS", func() {
+	var (
+		ca       *testAuthority
+		listener net.Listener
+		config   dialerConfig
+	)
+
+	BeforeEach(func() {
+		ca = newTestAuthority()
+		server := ca.issue("localhost")
+
+		listener, _ = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{server}})
+		go func(listener net.Listener) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+			}
+		}(listener)
+
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		config = dialerConfig{host: "localhost", port: port, ca: ca.file}
+		config.cert, config.key = writeTestCertificate()
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	dial := func() error {
+		credentials, err := loadTlsCredentials(config, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		conn, err := createTlsDialer(config, credentials).dial()
+		if conn != nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	It("verifies the server against the configured CA", func() {
+		Expect(dial()).To(Succeed())
+	})
+
+	It("rejects a server signed by a different CA", func() {
+		config.ca = newTestAuthority().file
+		Expect(dial()).To(MatchError(ContainSubstring("certificate verification failed")))
+	})
+
+	It("rejects a server whose certificate does not match the host name", func() {
+		config.host = "127.0.0.1"
+		Expect(dial()).To(MatchError(ContainSubstring("certificate verification failed")))
+	})
+
+	It("fails to load the credentials with an unreadable CA file", func() {
+		config.ca = "/does/not/exist"
+		_, err := loadTlsCredentials(config, nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reports verification failures in the connection status", func() {
+		config.ca = newTestAuthority().file
+		credentials, _ := loadTlsCredentials(config, nil)
+		lrscClient := &lrscConnection{dialer: createTlsDialer(config, credentials)}
+		lrscClient.StatusReporter = reporter.New()
+
+		lrscClient.establish()
+		Expect(lrscClient.Summary()).To(ContainSubstring("certificate verification failed"))
+	})
+
+	It("loads the client credentials and CA from a key archive", func() {
+		dir, _ := ioutil.TempDir("", "lrsc-archive")
+		os.MkdirAll(filepath.Join(dir, "certs"), 0700)
+		os.MkdirAll(filepath.Join(dir, "private"), 0700)
+		copyFile(config.cert, filepath.Join(dir, "certs", "AA-AA-AA-AA-FF-FF-FF-FF.CLIENT.cert"))
+		copyFile(config.key, filepath.Join(dir, "private", "AA-AA-AA-AA-FF-FF-FF-FF.CLIENT.key"))
+		copyFile(config.ca, filepath.Join(dir, "certs", "CA.cert"))
+
+		config = dialerConfig{host: config.host, port: config.port, archive: dir}
+		Expect(dial()).To(Succeed())
+	})
+
+	Describe("public key pinning", func() {
+		It("accepts a chain containing a pinned key", func() {
+			config.pins = []string{spkiFingerprint(ca.certificate)}
+			Expect(dial()).To(Succeed())
+		})
+
+		It("rejects a chain without a pinned key", func() {
+			config.pins = []string{spkiFingerprint(newTestAuthority().certificate)}
+			Expect(dial()).To(MatchError(ContainSubstring("pinned public key")))
+		})
+	})
+
+	Describe("parsePins", func() {
+		It("splits a comma separated list", func() {
+			Expect(parsePins("abc=, def= ,")).To(Equal([]string{"abc=", "def="}))
+		})
+
+		It("returns no pins for an empty setting", func() {
+			Expect(parsePins("")).To(BeEmpty())
+		})
+	})
+})
+
+func copyFile(from, to string) {
+	data, _ := ioutil.ReadFile(from)
+	ioutil.WriteFile(to, data, 0600)
+}
+
+type testAuthority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	file        string
+}
+
+func newTestAuthority() *testAuthority {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	certificate, _ := x509.ParseCertificate(der)
+
+	dir, _ := ioutil.TempDir("", "lrsc-ca")
+	file := filepath.Join(dir, "CA.cert")
+	ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	return &testAuthority{certificate: certificate, key: key, file: file}
+}
+
+func (self *testAuthority) issue(host string) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, self.certificate, &key.PublicKey, self.key)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/websocket"
+)
+
+type websocketDialer struct {
+	url, origin string
+	raddr       string
+	credentials *tlsCredentials
+	pins        []string
+}
+
+type websocketTransport struct {
+	conn *websocket.Conn
+}
+
+func createWebsocketDialer(config dialerConfig, credentials *tlsCredentials) dialer {
+	path := config.path
+	if path == "" {
+		path = "/"
+	}
+
+	raddr := fmt.Sprintf("%v:%v", config.host, config.port)
+	url := fmt.Sprintf("wss://%v%v", raddr, path)
+	origin := fmt.Sprintf("https://%v", config.host)
+	return &websocketDialer{url: url, origin: origin, raddr: raddr, credentials: credentials, pins: config.pins}
+}
+
+func (self *websocketDialer) dial() (transport, error) {
+	config, err := websocket.NewConfig(self.url, self.origin)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn, err := dialTls(self.raddr, self.credentials.context(), self.pins)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := websocket.NewClient(config, tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return &websocketTransport{conn: conn}, nil
+}
+
+func (self *websocketDialer) endpoint() string {
+	return self.url
+}
+
+func (self *websocketTransport) open() error {
+	return nil
+}
+
+func (self *websocketTransport) readMessage() (string, error) {
+	var message string
+	err := websocket.Message.Receive(self.conn, &message)
+	return message, err
+}
+
+func (self *websocketTransport) writeMessage(message string) error {
+	return websocket.Message.Send(self.conn, message)
+}
+
+func (self *websocketTransport) Close() error {
+	return self.conn.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/websocket"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("LRSC over websockets", func() {
+	var (
+		server   *httptest.Server
+		received chan string
+	)
+
+	BeforeEach(func() {
+		received = make(chan string, 10)
+		server = httptest.NewTLSServer(websocket.Handler(func(ws *websocket.Conn) {
+			var hello string
+			websocket.Message.Receive(ws, &hello)
+			received <- hello
+
+			websocket.Message.Send(ws, testHandshake)
+			websocket.Message.Send(ws, `{"msgtag":6,"deveui":"id","pdu":"data"}`)
+
+			var message string
+			for websocket.Message.Receive(ws, &message) == nil {
+				received <- message
+			}
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newDialer := func() *websocketDialer {
+		url := strings.Replace(server.URL, "https://", "wss://", 1) + "/"
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		raddr := server.Listener.Addr().String()
+		credentials := &tlsCredentials{sslContext: &tls.Config{RootCAs: roots}}
+		return &websocketDialer{url: url, origin: server.URL, raddr: raddr, credentials: credentials}
+	}
+
+	It("sends the hello as a single message without the line preamble", func() {
+		lrscClient := &lrscConnection{dialer: newDialer()}
+		lrscClient.StatusReporter = reporter.New()
+
+		Expect(lrscClient.establish()).To(Succeed())
+		Expect(<-received).To(HavePrefix(`{"msgtag":1`))
+	})
+
+	It("receives messages", func() {
+		lrscClient := &lrscConnection{dialer: newDialer()}
+		lrscClient.StatusReporter = reporter.New()
+		lrscClient.inbound = make(chan lrscMessage)
+		lrscClient.err = make(chan error)
+
+		Expect(lrscClient.establish()).To(Succeed())
+		go lrscClient.Loop()
+
+		Expect(<-lrscClient.inbound).To(Equal(lrscMessage{Type: messageTypeUpstream, DeviceGuid: "id", Payload: "data"}))
+	})
+
+	It("sends commands as websocket messages", func() {
+		lrscClient := &lrscConnection{dialer: newDialer()}
+		lrscClient.StatusReporter = reporter.New()
+
+		Expect(lrscClient.establish()).To(Succeed())
+		<-received
+
+		Expect(lrscClient.sendCommand(bridge.Command{Device: "device", Payload: "01ab"})).To(Succeed())
+
+		message, err := parseLrscMessage(<-received)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(message.DeviceGuid).To(Equal("device"))
+		Expect(message.Payload).To(Equal("01ab"))
+	})
+
+	Describe("choosing the transport", func() {
+		var config dialerConfig
+
+		BeforeEach(func() {
+			config = dialerConfig{host: "example.com", port: "443"}
+		})
+
+		It("uses websockets when configured", func() {
+			config.transport = "websocket"
+			config.path = "/lrsc"
+
+			dialer, err := createDialer(config, &tlsCredentials{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dialer.endpoint()).To(Equal("wss://example.com:443/lrsc"))
+		})
+
+		It("uses plain TLS by default", func() {
+			dialer, err := createDialer(config, &tlsCredentials{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dialer.endpoint()).To(Equal("example.com:443"))
+		})
+
+		It("rejects unknown transports", func() {
+			config.transport = "carrier-pigeon"
+
+			_, err := createDialer(config, &tlsCredentials{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/cromega/clogger"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/bridge"
+	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/deadletter"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/iotf"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/reporter"
 	"hub.jazz.net/git/bluemixgarage/lrsc-bridge/utils"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
 var logger clogger.Logger
 var lrscClient lrscConnection
+var deadLetters *deadletter.Queue
 
 func init() {
 	logger = utils.CreateLogger()
@@ -27,7 +33,7 @@ func main() {
 		logger.Fatal(err.Error())
 	}
 
-	setupHttp(reporters)
+	setupHttp(reporters, os.Getenv(adminTokenVariable))
 	err = startHttp()
 	if err != nil {
 		logger.Error(err.Error())
@@ -41,14 +47,31 @@ func startBridge() (map[string]reporter.StatusReporter, error) {
 	commands := make(chan bridge.Command)
 	events := make(chan iotf.Event)
 
+	capacity, err := strconv.Atoi(getenvWithDefault("DEAD_LETTER_CAPACITY", strconv.Itoa(deadletter.DefaultCapacity)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DEAD_LETTER_CAPACITY: %v", err)
+	}
+	deadLetters, err = deadletter.Open(os.Getenv("DEAD_LETTER_FILE"), capacity)
+	if err != nil {
+		appReporter.Report("DEAD_LETTERS", err.Error())
+		return nil, err
+	}
+
+	outbox, err := openOutbox()
+	if err != nil {
+		appReporter.Report("IOTF_QUEUE", err.Error())
+		return nil, err
+	}
+
 	deviceType := "LRSC"
-	iotfManager, err := iotf.NewIoTFManager(os.Getenv("VCAP_SERVICES"), commands, events, deviceType)
+	iotfManager, err := iotf.NewIoTFManager(os.Getenv("VCAP_SERVICES"), commands, events, deviceType, deadLetters, outbox)
 	if err != nil {
 		appReporter.Report("IoTF Manager:", err.Error())
 		return nil, err
 	}
 
-	if err := setupLrscClient(); err != nil {
+	results := make(chan bridge.CommandResult, 100)
+	if err := setupLrscClient(results); err != nil {
 		return nil, err
 	}
 
@@ -57,36 +80,120 @@ func startBridge() (map[string]reporter.StatusReporter, error) {
 	reporters["lrsc"] = lrscClient.StatusReporter
 	reporters["iotf"] = iotfManager.StatusReporter()
 
+	setupRedrive(commands, events)
+
 	go runConnectionLoop("LRSC client", &lrscClient)
 	go runConnectionLoop("IoTF client", iotfManager)
 
 	go func() {
 		for command := range commands {
-			lrscClient.sendCommand(command)
 			logger.Debug("Received command message: %v", command)
+			lrscClient.queueCommand(command)
+		}
+	}()
+
+	go func() {
+		for _ = range time.Tick(downlinkCheckInterval) {
+			lrscClient.expireDownlinks()
+			lrscClient.releaseQueuedDownlinks()
+			lrscClient.dutyCycle.prune()
+			lrscClient.radios.prune()
+			for _, event := range lrscClient.expireFragments() {
+				events <- event
+			}
+		}
+	}()
+
+	go func() {
+		for result := range results {
+			logger.Info("Command %v for %v %v %v", result.Command.CorrelationId, result.Command.Device, result.Status, result.Reason)
+			events <- iotf.NewCommandStatusEvent(result)
 		}
 	}()
 
 	go func() {
 		for {
 			message := <-lrscClient.inbound
-			event := iotf.Event{Device: message.DeviceGuid, Payload: message.Payload}
-			events <- event
+			for _, event := range lrscClient.eventsFromUplink(message) {
+				events <- event
+			}
+
+			if link := lrscClient.frames.observe(message); link != nil {
+				events <- *link
+			}
 		}
 	}()
 
 	return reporters, nil
 }
 
-func setupLrscClient() error {
+// openOutbox opens the queue of events waiting for IoTF to be reachable
+func openOutbox() (*iotf.Outbox, error) {
+	size, err := strconv.Atoi(getenvWithDefault("IOTF_QUEUE_SIZE", strconv.Itoa(iotf.DefaultOutboxSize)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid IOTF_QUEUE_SIZE: %v", err)
+	}
+
+	maxAge, err := time.ParseDuration(getenvWithDefault("IOTF_QUEUE_MAX_AGE", iotf.DefaultOutboxMaxAge.String()))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid IOTF_QUEUE_MAX_AGE: %v", err)
+	}
+
+	return iotf.OpenOutbox(os.Getenv("IOTF_QUEUE_FILE"), size, maxAge)
+}
+
+// setupRedrive hands redriven dead letters back to the stage they failed at
+func setupRedrive(commands chan<- bridge.Command, events chan<- iotf.Event) {
+	deadLetters.Handle(bridge.StageLrscParse, func(line string) error {
+		lrscClient.handleLine(line)
+		return nil
+	})
+
+	deadLetters.Handle(bridge.StageIoTFRegistration, func(payload string) error {
+		var event iotf.Event
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			return fmt.Errorf("Invalid event: %v", err)
+		}
+		events <- event
+		return nil
+	})
+
+	deadLetters.Handle(bridge.StageDownlink, func(payload string) error {
+		var command bridge.Command
+		if err := json.Unmarshal([]byte(payload), &command); err != nil {
+			return fmt.Errorf("Invalid command: %v", err)
+		}
+		commands <- command
+		return nil
+	})
+}
+
+func setupLrscClient(results chan<- bridge.CommandResult) error {
 	lrscClient.StatusReporter = reporter.New()
 	dialerConfig := dialerConfig{
 		host: os.Getenv("LRSC_HOST"),
 		port: os.Getenv("LRSC_PORT"),
 		cert: os.Getenv("LRSC_CLIENT_CERT"),
 		key:  os.Getenv("LRSC_CLIENT_KEY"),
+
+		ca:   os.Getenv("LRSC_CA_CERT"),
+		pins: parsePins(os.Getenv("LRSC_SPKI_PINS")),
+
+		archive:          os.Getenv("LRSC_KEY_ARCHIVE"),
+		eui:              os.Getenv("LRSC_EUI"),
+		keystorePassword: os.Getenv("LRSC_KEYSTORE_PASSWORD"),
+
+		transport: os.Getenv("LRSC_TRANSPORT"),
+		path:      os.Getenv("LRSC_WEBSOCKET_PATH"),
 	}
-	dialer, err := createTlsDialer(dialerConfig, &lrscClient.StatusReporter)
+	credentials, err := loadTlsCredentials(dialerConfig, &lrscClient.StatusReporter)
+	if err != nil {
+		logger.Error("failed to load credentials: %v", err)
+		lrscClient.Report("CONNECTION", err.Error())
+		return err
+	}
+
+	dialer, err := createDialer(dialerConfig, credentials)
 	if err != nil {
 		logger.Error("failed to create dialer: %v", err)
 		lrscClient.Report("CONNECTION", err.Error())
@@ -94,12 +201,73 @@ func setupLrscClient() error {
 	}
 
 	lrscClient.dialer = dialer
+	lrscClient.serverEui = os.Getenv("LRSC_SERVER_EUI")
 	lrscClient.err = make(chan error)
 	lrscClient.inbound = make(chan lrscMessage, 100)
+	// the connection hands its results on without waiting for the reader
+	results = bufferResults(results)
+	lrscClient.pending = newPendingDownlinks(results)
+	lrscClient.results = results
+
+	downlinks, err := openDownlinkQueue(os.Getenv("LRSC_DOWNLINK_QUEUE_FILE"))
+	if err != nil {
+		logger.Error("failed to open downlink queue: %v", err)
+		lrscClient.Report("DOWNLINK_QUEUE", err.Error())
+		return err
+	}
+	lrscClient.downlinks = downlinks
+
+	plan, err := findRegionalPlan(getenvWithDefault("LRSC_REGION", eu868.Name))
+	if err != nil {
+		lrscClient.Report("DUTY_CYCLE", err.Error())
+		return err
+	}
+	lrscClient.useRegionalPlan(plan)
+	lrscClient.fragments = newFragmentSessions()
+	lrscClient.restoreFragments()
+
+	devices, err := loadDeviceConfig(os.Getenv("LRSC_DEVICE_CONFIG"))
+	if err != nil {
+		logger.Error("failed to load device configuration: %v", err)
+		lrscClient.Report("DEVICE_CONFIG", err.Error())
+		return err
+	}
+	lrscClient.devices = devices
+
+	dedupWindow, err := time.ParseDuration(getenvWithDefault("LRSC_DEDUP_WINDOW", defaultDedupWindow.String()))
+	if err != nil {
+		return fmt.Errorf("Invalid LRSC_DEDUP_WINDOW: %v", err)
+	}
+	lrscClient.dedup = newUplinkDeduplicator(dedupWindow)
+
+	lossThreshold, err := strconv.ParseFloat(getenvWithDefault("LRSC_LINK_LOSS_THRESHOLD", "0"), 64)
+	if err != nil {
+		return fmt.Errorf("Invalid LRSC_LINK_LOSS_THRESHOLD: %v", err)
+	}
+	lrscClient.frames = newFrameCounters(lossThreshold)
+
+	lrscClient.deadLetters = deadLetters
+
+	reloadInterval, err := time.ParseDuration(getenvWithDefault("LRSC_CREDENTIALS_RELOAD_INTERVAL", "1m"))
+	if err != nil {
+		return fmt.Errorf("Invalid LRSC_CREDENTIALS_RELOAD_INTERVAL: %v", err)
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go credentials.watch(hangups, time.Tick(reloadInterval))
 
 	return nil
 }
 
+func getenvWithDefault(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
 type connection interface {
 	Connect() error
 	Error() <-chan error
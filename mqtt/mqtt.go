@@ -2,7 +2,7 @@ package mqtt
 
 type Client interface {
 	Start() error
-	PublishMessage(topic string, message []byte)
+	PublishMessage(topic string, message []byte) error
 	StartSubscription(topic string, callback func(message Message)) error
 }
 
@@ -1,9 +1,16 @@
 package mqtt
 
 import (
+	"errors"
 	paho "github.com/eclipse/paho.mqtt.golang"
+	"time"
 )
 
+// publishTimeout bounds how long a publish waits for the broker
+const publishTimeout = 10 * time.Second
+
+var errPublishTimeout = errors.New("timed out publishing message")
+
 type pahoClient struct {
 	client *paho.Client
 }
@@ -32,9 +39,13 @@ func (self *pahoClient) Start() error {
 	return token.Error()
 }
 
-func (self *pahoClient) PublishMessage(topic string, message []byte) {
+func (self *pahoClient) PublishMessage(topic string, message []byte) error {
 	client := *self.client
-	client.Publish(topic, 1, false, message)
+	token := client.Publish(topic, 1, false, message)
+	if !token.WaitTimeout(publishTimeout) {
+		return errPublishTimeout
+	}
+	return token.Error()
 }
 
 func (self *pahoClient) StartSubscription(topic string, callback func(message Message)) error {
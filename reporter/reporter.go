@@ -2,6 +2,7 @@ package reporter
 
 import (
 	"encoding/json"
+	"sync"
 )
 
 type StatusReporter interface {
@@ -9,15 +10,21 @@ type StatusReporter interface {
 	Summary() string
 }
 
+// BridgeReporter can be reported to and summarised from any goroutine
 type BridgeReporter struct {
+	lock  sync.RWMutex
 	stats map[string]string
 }
 
 func (self *BridgeReporter) Report(key, value string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	self.stats[key] = value
 }
 
 func (self *BridgeReporter) Summary() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
 	summary, _ := json.Marshal(self.stats)
 	return string(summary)
 }